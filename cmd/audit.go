@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Audit output writing JSON lines to the standard output instead of a file
+	auditStdout = "stdout"
+
+	signatureValid       = "valid"
+	signatureInvalid     = "invalid"
+	signatureNotRequired = "notRequired"
+	signatureNotChecked  = "notChecked"
+
+	auditDispatched = "dispatched"
+	auditIgnored    = "ignored"
+	auditRejected   = "rejected"
+)
+
+// AuditRecord describes a webhook request and what was done with it
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	RemoteIP     string    `json:"remoteIp"`
+	ForwardedFor string    `json:"forwardedFor,omitempty"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	DeliveryId   string    `json:"deliveryId,omitempty"`
+	EventType    string    `json:"eventType,omitempty"`
+	// Signature is valid, invalid, notRequired without configured secrets or notChecked for requests rejected earlier
+	Signature       string `json:"signature"`
+	SignatureSecret string `json:"signatureSecret,omitempty"`
+	Status          int    `json:"status"`
+	// Outcome is dispatched for events sent to subscribers, ignored for valid requests without events (e.g. pings)
+	// and rejected for invalid requests
+	Outcome string                 `json:"outcome"`
+	Reason  string                 `json:"reason,omitempty"`
+	Event   *SubscribeEventPayload `json:"event,omitempty"`
+	// Results of local reconciliation, if enabled
+	Results []ReconcileResult `json:"results,omitempty"`
+}
+
+func newAuditRecord(r *http.Request) *AuditRecord {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	return &AuditRecord{
+		Time:         time.Now().UTC(),
+		RemoteIP:     remoteIP,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		DeliveryId:   r.Header.Get("X-GitHub-Delivery"),
+		EventType:    r.Header.Get("X-GitHub-Event"),
+		Signature:    signatureNotChecked,
+	}
+}
+
+func (a *AuditRecord) reject(status int, reason string) {
+	a.Status = status
+	a.Outcome = auditRejected
+	a.Reason = reason
+}
+
+// AuditLog writes a JSON line for every webhook request, separately from the application log.
+// Lines are written unbuffered, so none are lost when the process exits.
+type AuditLog struct {
+	m      sync.Mutex
+	writer io.Writer
+}
+
+// NewAuditLog returns nil if the audit log is disabled, a nil audit log doesn't record anything
+func NewAuditLog(config Config) (*AuditLog, error) {
+	if !config.Audit.Enabled {
+		return nil, nil
+	}
+	if config.Audit.Output == auditStdout {
+		return &AuditLog{writer: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(config.Audit.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{writer: file}, nil
+}
+
+func (l *AuditLog) Write(record *AuditRecord) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	_, err = l.writer.Write(append(line, '\n'))
+	return err
+}
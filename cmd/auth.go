@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Name of the client authenticated with the shared subscribeSecret
+	sharedSecretClientName = "shared"
+
+	// Name of the client when subscribing doesn't require authentication
+	anonymousClientName = "anonymous"
+)
+
+var (
+	errMissingCredentials = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// subscriberCredentials extracts the subscriber token from the Authorization header,
+// falling back to the deprecated authSecret query parameter. The second result reports whether the fallback was used.
+func subscriberCredentials(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if found {
+			return strings.TrimSpace(token), false
+		}
+		return "", false
+	}
+	return r.URL.Query().Get("authSecret"), true
+}
+
+// subscriberIdentity describes an authenticated subscriber and what it may receive
+type subscriberIdentity struct {
+	Name string
+
+	// Registries limits events to images with these prefixes, empty means all images
+	Registries []string
+
+	// Namespaces limits reconciliation to these namespaces, empty means all namespaces
+	Namespaces []string
+
+	// ExpiresAt is when the credentials expire, zero if they don't
+	ExpiresAt time.Time
+}
+
+// authenticateSubscriber returns the identity of the client presenting the token.
+// JWTs are verified when a verifier is configured, other tokens are compared in constant time
+// with the shared secret and per-client tokens, and revoked tokens are rejected.
+func authenticateSubscriber(config Config, verifier *jwtVerifier, token string) (subscriberIdentity, error) {
+	if config.SubscribeSecret == "" && len(config.SubscribeTokens) == 0 && verifier == nil {
+		return subscriberIdentity{Name: anonymousClientName}, nil
+	}
+	if token == "" {
+		return subscriberIdentity{}, errMissingCredentials
+	}
+
+	if verifier != nil && isJWT(token) {
+		claims, err := verifier.Verify(token)
+		if err != nil {
+			return subscriberIdentity{}, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+		}
+		return subscriberIdentity{Name: claims.Cluster, Registries: claims.Registries, Namespaces: claims.Namespaces, ExpiresAt: claims.ExpiresAt.Time}, nil
+	}
+
+	name := ""
+	if config.SubscribeSecret != "" && secureCompare(token, config.SubscribeSecret) {
+		name = sharedSecretClientName
+	}
+	// check every token, so the time spent doesn't depend on which one matched
+	for _, subscribeToken := range config.SubscribeTokens {
+		if secureCompare(token, subscribeToken.Token) && !subscribeToken.Revoked && name == "" {
+			name = subscribeToken.Name
+		}
+	}
+
+	if name == "" {
+		return subscriberIdentity{}, errInvalidCredentials
+	}
+	return subscriberIdentity{Name: name}, nil
+}
+
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
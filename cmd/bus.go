@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	eventBusMemory = "memory"
+	eventBusRedis  = "redis"
+
+	// Redis channel events are published to when the config doesn't specify one
+	defaultRedisChannel = "flux-webhook-autoreconciler"
+
+	// Suffix of the Redis channel reports are forwarded on, separate from events so older replicas don't receive them
+	redisReportChannelSuffix = ":reports"
+)
+
+// EventBus distributes events received by one server replica to all replicas,
+// so each replica can deliver them to the subscribers connected to it
+type EventBus interface {
+	// Publish sends the event to every replica, including this one, which delivers it to its subscribers itself
+	Publish(ctx context.Context, event SubscribeEventPayload) error
+
+	// PublishReport sends the report to every replica, the replica it is addressed to records it
+	PublishReport(ctx context.Context, report ReportMessage) error
+
+	// Run receives events and reports published by any replica and delivers them until the context is done
+	Run(ctx context.Context)
+
+	// Ping checks that the bus is reachable
+	Ping(ctx context.Context) error
+}
+
+// newEventBus creates the configured event bus delivering received events with the deliver function
+// and received reports with the report function
+func newEventBus(config Config, deliver func(event SubscribeEventPayload), report func(report ReportMessage), logger *zap.Logger) EventBus {
+	if config.EventBus.Type == eventBusRedis {
+		return newRedisEventBus(config, deliver, report, logger)
+	}
+	return &memoryEventBus{deliver: deliver, report: report}
+}
+
+// memoryEventBus delivers events within the process, for a single replica, which ignores events it published itself
+type memoryEventBus struct {
+	deliver func(event SubscribeEventPayload)
+	report  func(report ReportMessage)
+}
+
+func (b *memoryEventBus) Publish(_ context.Context, event SubscribeEventPayload) error {
+	b.deliver(event)
+	return nil
+}
+
+func (b *memoryEventBus) PublishReport(_ context.Context, report ReportMessage) error {
+	b.report(report)
+	return nil
+}
+
+func (b *memoryEventBus) Run(context.Context) {}
+
+func (b *memoryEventBus) Ping(context.Context) error {
+	return nil
+}
+
+// redisEventBus distributes events between replicas with Redis pub/sub
+type redisEventBus struct {
+	client        *redis.Client
+	channel       string
+	reportChannel string
+	deliver       func(event SubscribeEventPayload)
+	report        func(report ReportMessage)
+	logger        *zap.Logger
+}
+
+func newRedisEventBus(config Config, deliver func(event SubscribeEventPayload), report func(report ReportMessage), logger *zap.Logger) *redisEventBus {
+	channel := config.EventBus.Redis.Channel
+	if channel == "" {
+		channel = defaultRedisChannel
+	}
+	return &redisEventBus{
+		client: redis.NewClient(&redis.Options{
+			Addr:     config.EventBus.Redis.Address,
+			Username: config.EventBus.Redis.Username,
+			Password: config.EventBus.Redis.Password,
+			DB:       config.EventBus.Redis.DB,
+		}),
+		channel:       channel,
+		reportChannel: channel + redisReportChannelSuffix,
+		deliver:       deliver,
+		report:        report,
+		logger:        logger,
+	}
+}
+
+// Publish sends the event in an envelope of the current protocol version, which carries its trace context
+func (b *redisEventBus) Publish(ctx context.Context, event SubscribeEventPayload) error {
+	data, err := encodeEvent(protocolVersion, event)
+	if err != nil {
+		return err
+	}
+	err = b.client.Publish(ctx, b.channel, data).Err()
+	if err != nil {
+		eventBusMessages.With(prometheus.Labels{"operation": "publish", "status": "fail"}).Inc()
+		return err
+	}
+	eventBusMessages.With(prometheus.Labels{"operation": "publish", "status": "success"}).Inc()
+	return nil
+}
+
+// PublishReport sends the report in an envelope of the current protocol version
+func (b *redisEventBus) PublishReport(ctx context.Context, report ReportMessage) error {
+	envelope, err := newEnvelope(protocolVersion, messageTypeReport, "", report)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	err = b.client.Publish(ctx, b.reportChannel, data).Err()
+	if err != nil {
+		eventBusMessages.With(prometheus.Labels{"operation": "publish", "status": "fail"}).Inc()
+		return err
+	}
+	eventBusMessages.With(prometheus.Labels{"operation": "publish", "status": "success"}).Inc()
+	return nil
+}
+
+func (b *redisEventBus) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// Run subscribes to the event and report channels, the client reconnects and resubscribes on connection failures
+func (b *redisEventBus) Run(ctx context.Context) {
+	defer b.client.Close()
+
+	pubsub := b.client.Subscribe(ctx, b.channel, b.reportChannel)
+	defer pubsub.Close()
+	b.logger.Info("Subscribed to Redis event bus", zap.String("address", b.client.Options().Addr), zap.String("channel", b.channel))
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			if message.Channel == b.reportChannel {
+				b.receiveReport([]byte(message.Payload))
+				continue
+			}
+			event, err := decodeBusMessage([]byte(message.Payload))
+			if err != nil {
+				b.logger.Error("Error unmarshalling event from bus", zap.Error(err))
+				eventBusMessages.With(prometheus.Labels{"operation": "receive", "status": "fail"}).Inc()
+				continue
+			}
+			eventBusMessages.With(prometheus.Labels{"operation": "receive", "status": "success"}).Inc()
+			b.deliver(event)
+		}
+	}
+}
+
+// receiveReport decodes a report forwarded by a replica and passes it on, ignoring messages of types it doesn't know
+func (b *redisEventBus) receiveReport(message []byte) {
+	envelope, ok := parseEnvelope(message)
+	if !ok {
+		b.logger.Error("Received report from bus without an envelope")
+		eventBusMessages.With(prometheus.Labels{"operation": "receive", "status": "fail"}).Inc()
+		return
+	}
+	if envelope.Type != messageTypeReport {
+		return
+	}
+	var report ReportMessage
+	if err := json.Unmarshal(envelope.Payload, &report); err != nil {
+		b.logger.Error("Error unmarshalling report from bus", zap.Error(err))
+		eventBusMessages.With(prometheus.Labels{"operation": "receive", "status": "fail"}).Inc()
+		return
+	}
+	eventBusMessages.With(prometheus.Labels{"operation": "receive", "status": "success"}).Inc()
+	b.report(report)
+}
+
+// decodeBusMessage decodes an event published by a replica of any version, older replicas publish bare events
+func decodeBusMessage(message []byte) (SubscribeEventPayload, error) {
+	envelope, err := decodeMessage(message)
+	if err != nil {
+		return SubscribeEventPayload{}, err
+	}
+	return decodeEvent(envelope)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"go.uber.org/zap"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisEventBus(t *testing.T) {
+	event := SubscribeEventPayload{
+		Id:           "event",
+		OciUrl:       "oci://ghcr.io/org/app",
+		Tag:          "v1",
+		Hops:         []string{"replica-0"},
+		TraceContext: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+	legacy, err := json.Marshal(SubscribeEventPayload{Id: "legacy", OciUrl: "oci://ghcr.io/org/app", Tag: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// publish sends a message to the channel
+		publish func(t *testing.T, bus *redisEventBus, server *miniredis.Miniredis)
+		want    *SubscribeEventPayload
+	}{
+		{
+			name: "event published by a replica",
+			publish: func(t *testing.T, bus *redisEventBus, server *miniredis.Miniredis) {
+				if err := bus.Publish(context.Background(), event); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: &event,
+		},
+		{
+			name: "bare event published by an older replica",
+			publish: func(t *testing.T, bus *redisEventBus, server *miniredis.Miniredis) {
+				server.Publish(defaultRedisChannel, string(legacy))
+			},
+			want: &SubscribeEventPayload{Id: "legacy", OciUrl: "oci://ghcr.io/org/app", Tag: "v1"},
+		},
+		{
+			name: "invalid message",
+			publish: func(t *testing.T, bus *redisEventBus, server *miniredis.Miniredis) {
+				server.Publish(defaultRedisChannel, "not json")
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := miniredis.RunT(t)
+			config := Config{}
+			config.EventBus.Type = eventBusRedis
+			config.EventBus.Redis.Address = server.Addr()
+
+			received := make(chan SubscribeEventPayload, 1)
+			bus := newRedisEventBus(config, func(event SubscribeEventPayload) {
+				received <- event
+			}, func(ReportMessage) {}, zap.NewNop())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go bus.Run(ctx)
+
+			if err := bus.Ping(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for server.PubSubNumSub(defaultRedisChannel)[defaultRedisChannel] == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			test.publish(t, bus, server)
+
+			select {
+			case got := <-received:
+				if test.want == nil {
+					t.Fatalf("received %+v, want nothing", got)
+				}
+				if !reflect.DeepEqual(got, *test.want) {
+					t.Errorf("received %+v, want %+v", got, *test.want)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.want != nil {
+					t.Fatal("event not received")
+				}
+			}
+		})
+	}
+}
+
+func TestRedisEventBusReports(t *testing.T) {
+	event := SubscribeEventPayload{Id: "event", OciUrl: "oci://ghcr.io/org/app", Tag: "v1", Hops: []string{"replica-0"}}
+	report := ReportMessage{Origin: "replica-0", Reporter: "subscriber", Event: &event, Cluster: "staging", Client: "staging", Reports: true}
+
+	server := miniredis.RunT(t)
+	config := Config{}
+	config.EventBus.Type = eventBusRedis
+	config.EventBus.Redis.Address = server.Addr()
+
+	events := make(chan SubscribeEventPayload, 1)
+	reports := make(chan ReportMessage, 1)
+	bus := newRedisEventBus(config, func(event SubscribeEventPayload) {
+		events <- event
+	}, func(report ReportMessage) {
+		reports <- report
+	}, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+
+	reportChannel := defaultRedisChannel + redisReportChannelSuffix
+	for server.PubSubNumSub(reportChannel)[reportChannel] == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// messages of unknown types are ignored
+	server.Publish(reportChannel, `{"version": 1, "type": "unknown", "id": "message"}`)
+	if err := bus.PublishReport(ctx, report); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-reports:
+		if !reflect.DeepEqual(got, report) {
+			t.Errorf("received %+v, want %+v", got, report)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("report not received")
+	}
+	select {
+	case got := <-events:
+		t.Errorf("received event %+v from the report channel", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,12 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	autoreconcilerv1 "flux-webhook-autoreconciler/api/v1"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
 	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,77 +37,510 @@ const (
 	retryDelay = time.Second * 5
 )
 
+var (
+	// errSessionExpired is returned by the poll transport when the server no longer knows the session
+	errSessionExpired = errors.New("poll session expired")
+
+	// errServerGoingAway is returned when the server closes the connection because it is shutting down
+	errServerGoingAway = errors.New("server is going away")
+)
+
 type Client struct {
 	serverEndpoint *url.URL
+	config         Config
+	dialer         *websocket.Dialer
+	httpClient     *http.Client
 	logger         *zap.Logger
-	reconciler     *Reconciler
+	handle         func(event SubscribeEventPayload) []ReconcileResult
 	retry          int
+	// events being handled, waited for on shutdown
+	inFlight sync.WaitGroup
+	// whether the client is connected to the server, reported by readiness
+	isConnected atomic.Bool
+
+	// protocol version and features negotiated on the current connection
+	version  int
+	features []string
+
+	// m guards settings applied on config reload and the cancellation of the current connection
+	m          sync.Mutex
+	disconnect context.CancelFunc
 }
 
-func NewClient(serverEndpoint *url.URL, reconciler *Reconciler, logger *zap.Logger) *Client {
+// NewClient creates a client that passes every event received from the server to the handle function
+func NewClient(serverEndpoint *url.URL, config Config, tlsConfig *tls.Config, handle func(event SubscribeEventPayload) []ReconcileResult, logger *zap.Logger) *Client {
 	return &Client{
 		serverEndpoint: serverEndpoint,
-		reconciler:     reconciler,
-		logger:         logger,
+		config:         config,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+			TLSClientConfig:  tlsConfig,
+		},
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		handle: handle,
+		logger: logger,
 	}
 }
 
 func (r *Client) Run(ctx context.Context) {
+	defer r.drain()
+
 	for r.retry < maxRetries {
-		r.logger.Info("Connecting to server")
+		r.logger.Info("Connecting to server", zap.String("transport", r.config.Transport))
 
 		connectionAttempts.Inc()
-		c, _, err := websocket.DefaultDialer.Dial(r.serverEndpoint.String(), nil)
+		// the connection is closed when the config reload changes the announced cluster or filters
+		connCtx, disconnect := context.WithCancel(ctx)
+		r.m.Lock()
+		r.disconnect = disconnect
+		r.m.Unlock()
+
+		var err error
+		switch r.config.Transport {
+		case transportSSE:
+			err = r.runSSE(connCtx)
+		case transportPoll:
+			err = r.runPoll(connCtx)
+		case transportGRPC:
+			err = r.runGRPC(connCtx)
+		default:
+			err = r.runWebsocket(connCtx)
+		}
+		disconnect()
+		r.isConnected.Store(false)
+
+		if ctx.Err() != nil {
+			r.logger.Debug("Context done, exiting client")
+			return
+		}
+		if errors.Is(err, errServerGoingAway) {
+			// the server is shutting down, another replica can take over right away
+			r.logger.Info("Server is going away, reconnecting")
+			continue
+		}
 		if err != nil {
 			time.Sleep(retryDelay)
 			r.retry++
 			r.logger.Error("Failed to connect to server", zap.Error(err), zap.Int("retry", r.retry))
 			continue
 		}
-		defer c.Close()
-		r.logger.Info("Connected to server")
+		r.logger.Debug("Client done, retrying connection")
+	}
+}
 
-		r.retry = 0
+// drain waits for events being handled to finish, so reconciliations aren't cut on shutdown
+func (r *Client) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.ShutdownTimeout)
+	defer cancel()
+	if err := waitContext(ctx, &r.inFlight); err != nil {
+		r.logger.Warn("Timed out waiting for in-flight reconciliations", zap.Error(err))
+	}
+}
 
-		doneChan := make(chan struct{})
+// connected resets the retry counter and the negotiated protocol once the client is connected
+func (r *Client) connected() {
+	r.logger.Info("Connected to server", zap.String("transport", r.config.Transport))
+	r.retry = 0
+	r.version = 0
+	r.features = nil
+	r.isConnected.Store(true)
+}
 
-		go func() {
-			defer close(doneChan)
-			for {
-				messageType, message, err := c.ReadMessage()
-				if err != nil {
+// Reload applies credentials, the cluster name and subscription filters of the reloaded config.
+// The client reconnects to announce a changed cluster name or filters.
+func (r *Client) Reload(config Config) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.config.SubscribeSecret = config.SubscribeSecret
+	r.config.SubscribeTokenFile = config.SubscribeTokenFile
+	if r.config.Cluster == config.Cluster && reflect.DeepEqual(r.config.Subscription, config.Subscription) {
+		return
+	}
+	r.config.Cluster = config.Cluster
+	r.config.Subscription = config.Subscription
+	if r.disconnect != nil {
+		r.logger.Info("Subscription changed, reconnecting", zap.String("cluster", config.Cluster), zap.Stringer("filters", config.Subscription))
+		r.disconnect()
+	}
+}
+
+// CheckConnected is a readiness check failing while the client isn't connected to the server
+func (r *Client) CheckConnected(context.Context) error {
+	if !r.isConnected.Load() {
+		return errors.New("not connected to the server")
+	}
+	return nil
+}
+
+// hello returns the message announcing the client, its filters and supported protocol versions and features
+func (r *Client) hello() HelloMessage {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return HelloMessage{
+		Type:     messageTypeHello,
+		Cluster:  r.config.Cluster,
+		Filters:  r.config.Subscription,
+		Versions: supportedProtocolVersions,
+		Features: []string{featureResults},
+	}
+}
+
+// runWebsocket receives events over a WebSocket connection. It returns an error if connecting fails
+// and nil when an established connection is closed.
+func (r *Client) runWebsocket(ctx context.Context) error {
+	header, err := r.authHeader()
+	if err != nil {
+		return err
+	}
+	c, _, err := r.dialer.Dial(r.serverEndpoint.String(), header)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.WriteJSON(r.hello()); err != nil {
+		return fmt.Errorf("failed to send hello message: %w", err)
+	}
+	r.connected()
+
+	doneChan := make(chan struct{})
+	var readErr error
+
+	go func() {
+		defer close(doneChan)
+		for {
+			messageType, message, err := c.ReadMessage()
+			if websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				readErr = errServerGoingAway
+				break
+			}
+			if err != nil {
+				// the connection is closed on purpose when the context is done
+				if ctx.Err() == nil {
 					r.logger.Error("Error reading message", zap.Error(err))
 					processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
-					break
 				}
+				break
+			}
 
-				if messageType != websocket.BinaryMessage {
-					r.logger.Info("Received non-binary message", zap.String("message", string(message)))
-					processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
-					continue
-				}
+			if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
+				continue
+			}
 
-				var payload SubscribeEventPayload
-				err = json.Unmarshal(message, &payload)
+			result, err := r.processMessage(message)
+			if err != nil {
+				break
+			}
+			if result != nil && contains(r.features, featureResults) {
+				envelope, err := newEnvelope(r.version, messageTypeResult, "", result)
 				if err != nil {
-					r.logger.Error("Error unmarshalling message", zap.Error(err))
-					processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
+					r.logger.Error("Error marshalling result", zap.Error(err))
+					continue
+				}
+				if err := c.WriteJSON(envelope); err != nil {
+					r.logger.Error("Error sending result", zap.Error(err))
 					break
 				}
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		_ = c.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+		return nil
+	case <-doneChan:
+		return readErr
+	}
+}
+
+// runSSE receives events from the Server-Sent Events endpoint
+func (r *Client) runSSE(ctx context.Context) error {
+	resp, err := r.get(ctx, r.transportEndpoint("sse", nil))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	r.connected()
 
-				r.logger.Info("Received message", zap.String("ociUrl", payload.OciUrl), zap.String("tag", payload.Tag))
-				r.reconciler.ReconcileSources(payload.OciUrl, payload.Tag)
-				processedMessages.With(prometheus.Labels{"status": "success"}).Inc()
+	var eventType string
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// blank line ends the event
+			if eventType == sseEventGoingAway {
+				return errServerGoingAway
 			}
-		}()
+			eventType = ""
+			if data.Len() > 0 {
+				if _, err := r.processMessage([]byte(data.String())); err != nil {
+					return nil
+				}
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteString("\n")
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
 
-		select {
-		case <-ctx.Done():
-			r.logger.Debug("Context done, exiting client")
-			return
-		case <-doneChan:
-			r.logger.Debug("Client done, retrying connection")
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		r.logger.Error("Error reading message", zap.Error(err))
+		processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
+	}
+	return nil
+}
+
+// runGRPC receives events over the gRPC Subscribe stream, acknowledging every event and reporting its results
+func (r *Client) runGRPC(ctx context.Context) error {
+	creds := insecure.NewCredentials()
+	if !r.config.GRPC.Insecure {
+		creds = credentials.NewTLS(r.dialer.TLSClientConfig)
+	}
+	conn, err := grpc.DialContext(ctx, r.config.GRPC.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	header, err := r.authHeader()
+	if err != nil {
+		return err
+	}
+	if auth := header.Get("Authorization"); auth != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+	}
+
+	stream, err := autoreconcilerv1.NewSubscriberServiceClient(conn).Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	announced := r.hello()
+	hello := &autoreconcilerv1.Hello{Cluster: announced.Cluster, Filters: filtersToProto(announced.Filters)}
+	if err := stream.Send(&autoreconcilerv1.SubscribeRequest{Message: &autoreconcilerv1.SubscribeRequest_Hello{Hello: hello}}); err != nil {
+		return fmt.Errorf("failed to send hello message: %w", err)
+	}
+	r.connected()
+
+	for {
+		response, err := stream.Recv()
+		if s := status.Convert(err); s.Code() == codes.Unavailable && s.Message() == goingAwayReason {
+			return errServerGoingAway
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Error("Error reading message", zap.Error(err))
+				processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
+			}
+			return nil
+		}
+
+		event := response.GetEvent()
+		if event == nil {
 			continue
 		}
+		ack := &autoreconcilerv1.Ack{EventId: event.GetId()}
+		if err := stream.Send(&autoreconcilerv1.SubscribeRequest{Message: &autoreconcilerv1.SubscribeRequest_Ack{Ack: ack}}); err != nil {
+			r.logger.Error("Error sending ack", zap.Error(err))
+			return nil
+		}
+
+		results := r.processEvent(eventFromProto(event))
+		result := resultsToProto(event.GetId(), results)
+		if err := stream.Send(&autoreconcilerv1.SubscribeRequest{Message: &autoreconcilerv1.SubscribeRequest_Result{Result: result}}); err != nil {
+			r.logger.Error("Error sending result", zap.Error(err))
+			return nil
+		}
+	}
+}
+
+// runPoll receives events by long-polling the poll endpoint until the session expires or polling fails
+func (r *Client) runPoll(ctx context.Context) error {
+	response, err := r.poll(ctx, "")
+	if err != nil {
+		return err
+	}
+	session := response.Session
+	r.connected()
+	for _, envelope := range response.Messages {
+		r.processEnvelope(envelope)
+	}
+
+	for ctx.Err() == nil {
+		response, err := r.poll(ctx, session)
+		if err != nil {
+			if !errors.Is(err, errSessionExpired) && ctx.Err() == nil {
+				r.logger.Error("Error polling events", zap.Error(err))
+				processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
+			}
+			return nil
+		}
+
+		for _, event := range response.Events {
+			r.processEvent(event)
+		}
+		for _, envelope := range response.Messages {
+			r.processEnvelope(envelope)
+		}
+	}
+	return nil
+}
+
+func (r *Client) poll(ctx context.Context, session string) (PollResponse, error) {
+	var response PollResponse
+
+	query := url.Values{}
+	if session != "" {
+		query.Set("session", session)
+	}
+	resp, err := r.get(ctx, r.transportEndpoint("poll", query))
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && session != "" {
+		return response, errSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+// get performs an authenticated request, announcing the client in the hello query parameter
+func (r *Client) get(ctx context.Context, endpoint *url.URL) (*http.Response, error) {
+	header, err := r.authHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := json.Marshal(r.hello())
+	if err != nil {
+		return nil, err
+	}
+	query := endpoint.Query()
+	query.Set("hello", string(hello))
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return r.httpClient.Do(req)
+}
+
+// transportEndpoint derives the HTTP endpoint of the transport from the WebSocket server endpoint,
+// e.g. wss://example.com/subscribe becomes https://example.com/subscribe/sse
+func (r *Client) transportEndpoint(transport string, query url.Values) *url.URL {
+	endpoint := *r.serverEndpoint
+	switch endpoint.Scheme {
+	case "ws":
+		endpoint.Scheme = "http"
+	case "wss":
+		endpoint.Scheme = "https"
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + transport
+	if query != nil {
+		endpoint.RawQuery = query.Encode()
+	}
+	return &endpoint
+}
+
+// processMessage decodes a message of any protocol version and handles it.
+// If the message carried an event, it returns the reconciliation results of the event.
+func (r *Client) processMessage(message []byte) (*ResultMessage, error) {
+	envelope, err := decodeMessage(message)
+	if err != nil {
+		r.logger.Error("Error unmarshalling message", zap.Error(err))
+		processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
+		return nil, err
+	}
+
+	return r.processEnvelope(envelope), nil
+}
+
+// processEnvelope handles the message, ignoring message types introduced by newer servers
+func (r *Client) processEnvelope(envelope Envelope) *ResultMessage {
+	switch envelope.Type {
+	case messageTypeWelcome:
+		var welcome WelcomeMessage
+		if err := json.Unmarshal(envelope.Payload, &welcome); err != nil {
+			r.logger.Error("Error unmarshalling message", zap.Error(err))
+			return nil
+		}
+		r.version = welcome.Version
+		r.features = welcome.Features
+		r.logger.Info("Negotiated protocol", zap.Int("version", welcome.Version), zap.Strings("features", welcome.Features))
+	case messageTypeEvent:
+		payload, err := decodeEvent(envelope)
+		if err != nil {
+			r.logger.Error("Error unmarshalling message", zap.Error(err))
+			processedMessages.With(prometheus.Labels{"status": "fail"}).Inc()
+			return nil
+		}
+		return &ResultMessage{EventId: payload.Id, Results: r.processEvent(payload)}
+	default:
+		r.logger.Debug("Ignoring message of unknown type", zap.String("type", envelope.Type), zap.Int("version", envelope.Version))
+	}
+	return nil
+}
+
+func (r *Client) processEvent(payload SubscribeEventPayload) []ReconcileResult {
+	r.logger.Info("Received message", zap.String("ociUrl", payload.OciUrl), zap.String("tag", payload.Tag))
+	r.inFlight.Add(1)
+	defer r.inFlight.Done()
+
+	// the span joins the trace of the server if the event carries its trace context
+	ctx, span := tracer.Start(payload.traceContext(), "Client.Run", eventAttributes(payload),
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attribute.String("transport", r.config.Transport)))
+	defer span.End()
+
+	results := r.handle(payload.withTraceContext(ctx))
+	processedMessages.With(prometheus.Labels{"status": "success"}).Inc()
+	return results
+}
+
+// authHeader returns headers authenticating the client. The token file is read on every connection,
+// so tokens refreshed on disk (e.g. projected service account tokens) are picked up on reconnect.
+func (r *Client) authHeader() (http.Header, error) {
+	r.m.Lock()
+	token, tokenFile := r.config.SubscribeSecret, r.config.SubscribeTokenFile
+	r.m.Unlock()
+
+	header := http.Header{}
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
 	}
+	return header, nil
 }
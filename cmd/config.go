@@ -1,39 +1,206 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
+	"io"
 	"os"
+	"time"
 )
 
+// Config file loaded when the --config flag isn't set, if it exists
+const defaultConfigPath = "config.yaml"
+
+// Paths served by the HTTP server itself, webhook endpoints can't use them
+var reservedPaths = []string{"/webhook", "/subscribe", "/subscribe/sse", "/subscribe/poll", "/healthz", "/readyz"}
+
+// Name of the secret from the githubSecret field in signature metrics
+const primaryGithubSecretName = "primary"
+
+// Default shutdown timeout, fits into the default termination grace period of Kubernetes pods
+const defaultShutdownTimeout = 25 * time.Second
+
 type Config struct {
-	Mode            string `yaml:"mode" validate:"required,oneof=server client"`
-	GithubSecret    string `yaml:"githubSecret"`
-	Host            string `yaml:"host"`
-	Port            string `yaml:"port"`
-	ServerEndpoint  string `yaml:"serverEndpoint"`
-	SubscribeSecret string `yaml:"subscribeSecret"`
-	Metrics         struct {
+	Mode            string           `yaml:"mode" validate:"required,oneof=server client relay"`
+	InstanceId      string           `yaml:"instanceId"`
+	GithubSecret    string           `yaml:"githubSecret" env:"GITHUB_WEBHOOK_SECRET" secret:"true"`
+	GithubSecrets   []WebhookSecret  `yaml:"githubSecrets" secret:"true" validate:"dive"`
+	Host            string           `yaml:"host"`
+	Port            string           `yaml:"port"`
+	ServerEndpoint  string           `yaml:"serverEndpoint"`
+	Transport       string           `yaml:"transport" validate:"omitempty,oneof=websocket sse poll grpc"`
+	SubscribeSecret string           `yaml:"subscribeSecret" env:"SUBSCRIBE_SECRET" secret:"true"`
+	SubscribeTokens []SubscribeToken `yaml:"subscribeTokens" secret:"true" validate:"dive"`
+	JWT             struct {
+		HMACKey  string `yaml:"hmacKey" secret:"true"`
+		JWKSFile string `yaml:"jwksFile"`
+		Issuer   string `yaml:"issuer"`
+		Audience string `yaml:"audience"`
+	} `yaml:"jwt"`
+	SubscribeTokenFile string              `yaml:"subscribeTokenFile"`
+	Cluster            string              `yaml:"cluster"`
+	Subscription       SubscriptionFilters `yaml:"subscription"`
+	TLS                struct {
+		CertFile          string `yaml:"certFile" validate:"required_with=KeyFile"`
+		KeyFile           string `yaml:"keyFile" validate:"required_with=CertFile"`
+		ClientCAFile      string `yaml:"clientCAFile"`
+		RequireClientCert bool   `yaml:"requireClientCert" validate:"excluded_without=ClientCAFile"`
+		CAFile            string `yaml:"caFile"`
+	} `yaml:"tls"`
+	Metrics struct {
 		Enabled bool   `yaml:"enabled"`
 		Host    string `yaml:"host"`
 		Port    string `yaml:"port"`
 	} `yaml:"metrics"`
+	ImageAutomation struct {
+		Enabled                    bool `yaml:"enabled"`
+		ReconcileUpdateAutomations bool `yaml:"reconcileUpdateAutomations"`
+	} `yaml:"imageAutomation"`
+	Policies struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"policies"`
+	Webhooks []WebhookEndpoint `yaml:"webhooks" validate:"dive"`
+	Relay    struct {
+		UpstreamSecret string `yaml:"upstreamSecret" secret:"true"`
+		// Reconcile is a deprecated alias of the top-level reconcile setting
+		Reconcile *bool `yaml:"reconcile"`
+	} `yaml:"relay"`
+	GRPC struct {
+		// Enabled serves the gRPC API next to the HTTP endpoints
+		Enabled bool   `yaml:"enabled"`
+		Host    string `yaml:"host"`
+		Port    string `yaml:"port"`
+		// AdminToken is required by admin RPCs, which are disabled without it
+		AdminToken string `yaml:"adminToken" secret:"true"`
+		// Endpoint is the address of the server's gRPC API used by clients with the grpc transport
+		Endpoint string `yaml:"endpoint"`
+		// Insecure connects to the gRPC endpoint without TLS
+		Insecure bool `yaml:"insecure"`
+	} `yaml:"grpc"`
+	// Reconcile enables reconciliation of sources in the local cluster, enabled by default except in relay mode
+	Reconcile *bool `yaml:"reconcile"`
+	EventBus  struct {
+		Type  string `yaml:"type" validate:"omitempty,oneof=memory redis"`
+		Redis struct {
+			Address  string `yaml:"address" validate:"required_if=Type redis"`
+			Username string `yaml:"username"`
+			Password string `yaml:"password" secret:"true"`
+			DB       int    `yaml:"db"`
+			Channel  string `yaml:"channel"`
+		} `yaml:"redis"`
+	} `yaml:"eventBus"`
+	LeaderElection struct {
+		Enabled        bool          `yaml:"enabled"`
+		LeaseName      string        `yaml:"leaseName"`
+		LeaseNamespace string        `yaml:"leaseNamespace"`
+		LeaseDuration  time.Duration `yaml:"leaseDuration"`
+		RenewDeadline  time.Duration `yaml:"renewDeadline" validate:"ltfield=LeaseDuration"`
+		RetryPeriod    time.Duration `yaml:"retryPeriod"`
+	} `yaml:"leaderElection"`
+	// ShutdownTimeout limits how long shutdown waits for in-flight webhooks and reconciliations
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	Notifications   struct {
+		// Window is how long results reported by clusters are collected before notifying
+		Window    time.Duration    `yaml:"window"`
+		Notifiers []NotifierConfig `yaml:"notifiers" validate:"dive"`
+	} `yaml:"notifications"`
+	// GithubStatus reports the outcome of events in every cluster to the commit the pushed image was built from
+	GithubStatus struct {
+		Enabled bool `yaml:"enabled"`
+		// Type is commit for commit statuses or deployment for deployments with an environment per cluster
+		Type string `yaml:"type" validate:"omitempty,oneof=commit deployment"`
+		// APIURL is the base URL of the GitHub API, e.g. https://github.example.com/api/v3 for GitHub Enterprise Server
+		APIURL  string `yaml:"apiUrl" validate:"omitempty,url"`
+		Token   string `yaml:"token" secret:"true"`
+		Context string `yaml:"context"`
+	} `yaml:"githubStatus"`
+	// Audit records every webhook request as a JSON line
+	Audit struct {
+		Enabled bool `yaml:"enabled"`
+		// Output is a file path or stdout
+		Output string `yaml:"output"`
+	} `yaml:"audit"`
+	// ReadyTracking waits for reconciled objects to become ready and records the time from push to readiness
+	ReadyTracking struct {
+		Enabled  bool          `yaml:"enabled"`
+		Timeout  time.Duration `yaml:"timeout"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"readyTracking"`
+	Tracing struct {
+		// Enabled exports spans with OTLP over gRPC, spans aren't recorded without it
+		Enabled     bool   `yaml:"enabled"`
+		Endpoint    string `yaml:"endpoint"`
+		Insecure    bool   `yaml:"insecure"`
+		ServiceName string `yaml:"serviceName"`
+		// SampleRatio is the fraction of new traces sampled, traces started upstream follow the upstream decision.
+		// It is 1 by default, 0 samples no new traces.
+		SampleRatio *float64 `yaml:"sampleRatio" validate:"omitempty,gte=0,lte=1"`
+	} `yaml:"tracing"`
+	LogLevel string `yaml:"logLevel" validate:"oneof=debug info warn error dpanic panic fatal"`
+	// Reload watches the config file and files it references, applying changes of secrets, subscription filters,
+	// notifications and the log level without restart
+	Reload struct {
+		// Enabled is true by default
+		Enabled  *bool         `yaml:"enabled"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"reload"`
+
+	// secretFiles are files secrets were read from, they are watched like the config file
+	secretFiles []string
+}
+
+// WebhookSecret is one of the secrets accepted for webhook signatures, used to rotate secrets without downtime
+type WebhookSecret struct {
+	Name      string     `yaml:"name" validate:"required"`
+	Secret    string     `yaml:"secret" validate:"required"`
+	ExpiresAt *time.Time `yaml:"expiresAt"`
+}
+
+// SubscribeToken is a named per-client credential for the subscribe endpoint
+type SubscribeToken struct {
+	Name    string `yaml:"name" validate:"required"`
+	Token   string `yaml:"token" validate:"required"`
+	Revoked bool   `yaml:"revoked"`
+}
+
+// WebhookEndpoint is an additional webhook path verified with a secret stored in a Kubernetes Secret.
+// Events received on it may only reconcile sources of the Secret's namespace.
+type WebhookEndpoint struct {
+	Path      string `yaml:"path" validate:"required,startswith=/"`
+	SecretRef struct {
+		Namespace string `yaml:"namespace" validate:"required"`
+		Name      string `yaml:"name" validate:"required"`
+		Key       string `yaml:"key"`
+	} `yaml:"secretRef"`
+	// Namespaces are namespaces besides the one of the Secret whose sources events of the endpoint may reconcile
+	Namespaces []string `yaml:"namespaces" validate:"dive,required"`
 }
 
-func LoadConfig(configPath string) (Config, error) {
+// LoadConfig reads the config file, if any, and applies overrides from environment variables and flags.
+// Settings are taken from flags first, then from environment variables, the config file and finally defaults.
+func LoadConfig(configPath string, flags ConfigFlags) (Config, error) {
 	var config Config
 
-	file, err := os.Open(configPath)
-	if err != nil {
-		return config, err
-	}
-	defer file.Close()
+	if configPath != "" {
+		file, err := os.Open(configPath)
+		if err != nil {
+			return config, err
+		}
+		defer file.Close()
 
-	// Init new YAML decode
-	d := yaml.NewDecoder(file)
+		// Init new YAML decode
+		d := yaml.NewDecoder(file)
 
-	// Start YAML decoding from file
-	if err := d.Decode(&config); err != nil {
+		// Start YAML decoding from file, an empty file is a valid config
+		if err := d.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return config, err
+		}
+	}
+
+	if err := config.applyOverrides(flags); err != nil {
 		return config, err
 	}
 
@@ -45,16 +212,110 @@ func LoadConfig(configPath string) (Config, error) {
 		config.Port = "3400"
 	}
 
-	if config.ServerEndpoint == "" {
-		config.ServerEndpoint = "ws://localhost:3400/subscribe"
+	if config.Relay.Reconcile != nil {
+		if config.Reconcile != nil && *config.Reconcile != *config.Relay.Reconcile {
+			return config, errors.New("relay.reconcile is deprecated and conflicts with reconcile, remove it")
+		}
+		config.Reconcile = config.Relay.Reconcile
+	}
+
+	if config.Reconcile == nil {
+		reconcile := config.Mode != "relay"
+		config.Reconcile = &reconcile
+	}
+
+	if config.LeaderElection.LeaseDuration == 0 {
+		config.LeaderElection.LeaseDuration = 15 * time.Second
+	}
+
+	if config.LeaderElection.RenewDeadline == 0 {
+		config.LeaderElection.RenewDeadline = 10 * time.Second
+	}
+
+	if config.LeaderElection.RetryPeriod == 0 {
+		config.LeaderElection.RetryPeriod = 2 * time.Second
+	}
+
+	if config.EventBus.Type == "" {
+		config.EventBus.Type = eventBusMemory
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	if config.Notifications.Window == 0 {
+		config.Notifications.Window = defaultNotificationWindow
+	}
+
+	if config.GithubStatus.Type == "" {
+		config.GithubStatus.Type = githubStatusCommit
+	}
+
+	if config.GithubStatus.APIURL == "" {
+		config.GithubStatus.APIURL = defaultGithubAPIURL
+	}
+
+	if config.GithubStatus.Context == "" {
+		config.GithubStatus.Context = defaultGithubStatusContext
+	}
+
+	if config.Audit.Output == "" {
+		config.Audit.Output = auditStdout
+	}
+
+	if config.ReadyTracking.Timeout == 0 {
+		config.ReadyTracking.Timeout = defaultReadyTrackingTimeout
 	}
 
-	if os.Getenv("GITHUB_WEBHOOK_SECRET") != "" {
-		config.GithubSecret = os.Getenv("GITHUB_WEBHOOK_SECRET")
+	if config.ReadyTracking.Interval == 0 {
+		config.ReadyTracking.Interval = defaultReadyTrackingInterval
 	}
 
-	if os.Getenv("SUBSCRIBE_SECRET") != "" {
-		config.SubscribeSecret = os.Getenv("SUBSCRIBE_SECRET")
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+
+	if config.Reload.Enabled == nil {
+		enabled := true
+		config.Reload.Enabled = &enabled
+	}
+
+	if config.Reload.Interval == 0 {
+		config.Reload.Interval = defaultConfigReloadInterval
+	}
+
+	if config.Tracing.Endpoint == "" {
+		config.Tracing.Endpoint = "localhost:4317"
+	}
+
+	if config.Tracing.SampleRatio == nil {
+		ratio := 1.0
+		config.Tracing.SampleRatio = &ratio
+	}
+
+	if config.Transport == "" {
+		config.Transport = transportWebsocket
+	}
+
+	if config.GRPC.Host == "" {
+		config.GRPC.Host = config.Host
+	}
+
+	if config.GRPC.Port == "" {
+		config.GRPC.Port = "3401"
+	}
+
+	if config.GRPC.Endpoint == "" {
+		config.GRPC.Endpoint = "localhost:3401"
+	}
+
+	if config.InstanceId == "" {
+		config.InstanceId = uuid.New().String()
+	}
+
+	if config.ServerEndpoint == "" {
+		config.ServerEndpoint = "ws://localhost:3400/subscribe"
 	}
 
 	validate := validator.New(validator.WithRequiredStructEnabled())
@@ -63,5 +324,63 @@ func LoadConfig(configPath string) (Config, error) {
 		return config, err
 	}
 
+	if err := config.Subscription.Validate(); err != nil {
+		return config, err
+	}
+
+	if err := config.validateWebhooks(); err != nil {
+		return config, err
+	}
+
+	if err := config.validateLeaderElection(); err != nil {
+		return config, err
+	}
+
 	return config, nil
 }
+
+// validateLeaderElection rejects leader election of servers without a shared event bus,
+// since the leader would never see webhooks received by followers, which then don't reconcile them
+func (c Config) validateLeaderElection() error {
+	if c.Mode == "server" && c.LeaderElection.Enabled && c.EventBus.Type == eventBusMemory {
+		return fmt.Errorf("leaderElection: servers require eventBus.type %s to reconcile webhooks received by followers", eventBusRedis)
+	}
+	return nil
+}
+
+// validateWebhooks rejects webhook endpoints the HTTP server can't register: reserved paths and paths listed twice
+func (c Config) validateWebhooks() error {
+	paths := make(map[string]bool)
+	for _, endpoint := range c.Webhooks {
+		if contains(reservedPaths, endpoint.Path) {
+			return fmt.Errorf("webhooks: path %s is reserved, reserved paths are %v", endpoint.Path, reservedPaths)
+		}
+		if paths[endpoint.Path] {
+			return fmt.Errorf("webhooks: path %s is listed more than once", endpoint.Path)
+		}
+		paths[endpoint.Path] = true
+	}
+	return nil
+}
+
+// HasGithubSecrets reports whether any webhook secret is configured, expired ones included.
+// Webhooks are only accepted unsigned if none is.
+func (c Config) HasGithubSecrets() bool {
+	return c.GithubSecret != "" || len(c.GithubSecrets) > 0
+}
+
+// ActiveGithubSecrets returns secrets webhook signatures are checked against, in the order they are tried:
+// the primary secret first, then not yet expired secrets from the githubSecrets list
+func (c Config) ActiveGithubSecrets(now time.Time) []WebhookSecret {
+	var secrets []WebhookSecret
+	if c.GithubSecret != "" {
+		secrets = append(secrets, WebhookSecret{Name: primaryGithubSecretName, Secret: c.GithubSecret})
+	}
+	for _, secret := range c.GithubSecrets {
+		if secret.ExpiresAt != nil && now.After(*secret.ExpiresAt) {
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
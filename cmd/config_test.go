@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateWebhooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		wantErr bool
+	}{
+		{name: "no endpoints"},
+		{name: "distinct paths", paths: []string{"/webhook/team-a", "/webhook/team-b"}},
+		{name: "webhook path", paths: []string{"/webhook"}, wantErr: true},
+		{name: "SSE path", paths: []string{"/subscribe/sse"}, wantErr: true},
+		{name: "poll path", paths: []string{"/subscribe/poll"}, wantErr: true},
+		{name: "liveness probe path", paths: []string{"/healthz"}, wantErr: true},
+		{name: "readiness probe path", paths: []string{"/readyz"}, wantErr: true},
+		{name: "duplicate path", paths: []string{"/webhook/team-a", "/webhook/team-a"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{}
+			for _, path := range test.paths {
+				config.Webhooks = append(config.Webhooks, WebhookEndpoint{Path: path})
+			}
+			if err := config.validateWebhooks(); (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLeaderElection(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           string
+		leaderElection bool
+		eventBus       string
+		wantErr        bool
+	}{
+		{name: "server without leader election", mode: "server", eventBus: eventBusMemory},
+		{name: "server with redis bus", mode: "server", leaderElection: true, eventBus: eventBusRedis},
+		{name: "server with memory bus", mode: "server", leaderElection: true, eventBus: eventBusMemory, wantErr: true},
+		{name: "client with memory bus", mode: "client", leaderElection: true, eventBus: eventBusMemory},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{Mode: test.mode}
+			config.LeaderElection.Enabled = test.leaderElection
+			config.EventBus.Type = test.eventBus
+			if err := config.validateLeaderElection(); (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    float64
+		wantErr bool
+	}{
+		{name: "default", config: "mode: server\n", want: 1},
+		{name: "no new traces", config: "mode: server\ntracing:\n  sampleRatio: 0\n", want: 0},
+		{name: "fraction", config: "mode: server\ntracing:\n  sampleRatio: 0.25\n", want: 0.25},
+		{name: "above 1", config: "mode: server\ntracing:\n  sampleRatio: 2\n", wantErr: true},
+		{name: "negative", config: "mode: server\ntracing:\n  sampleRatio: -0.5\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path, nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && *config.Tracing.SampleRatio != test.want {
+				t.Errorf("sample ratio %v, want %v", *config.Tracing.SampleRatio, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const (
+	githubStatusCommit     = "commit"
+	githubStatusDeployment = "deployment"
+
+	defaultGithubAPIURL        = "https://api.github.com"
+	defaultGithubStatusContext = "flux-webhook-autoreconciler"
+
+	// GitHub rejects longer status descriptions
+	githubDescriptionLimit = 140
+)
+
+// GithubReporter reports the outcome of events in every cluster back to the commit the pushed image was built from,
+// as commit statuses or as deployments with an environment per cluster
+type GithubReporter struct {
+	apiURL     string
+	token      string
+	kind       string
+	context    string
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+// NewGithubReporter returns nil if reporting is disabled
+func NewGithubReporter(config Config, logger *zap.Logger) *GithubReporter {
+	if !config.GithubStatus.Enabled {
+		return nil
+	}
+	return &GithubReporter{
+		apiURL:     strings.TrimSuffix(config.GithubStatus.APIURL, "/"),
+		token:      config.GithubStatus.Token,
+		kind:       config.GithubStatus.Type,
+		context:    config.GithubStatus.Context,
+		httpClient: &http.Client{Timeout: notifyTimeout},
+		logger:     logger,
+	}
+}
+
+// Report creates a status for every cluster in the summary. Events without a known repository and commit are skipped.
+func (g *GithubReporter) Report(summary EventSummary) error {
+	if summary.Repository == "" || summary.Revision == "" {
+		g.logger.Debug("Repository or commit of the event are unknown, not reporting status", zap.String("eventId", summary.EventId))
+		return nil
+	}
+
+	for _, cluster := range summary.Clusters {
+		state, description := clusterStatus(summary, cluster)
+		var err error
+		if g.kind == githubStatusDeployment {
+			err = g.reportDeployment(summary, cluster, state, description)
+		} else {
+			err = g.post(fmt.Sprintf("/repos/%s/statuses/%s", summary.Repository, summary.Revision), map[string]string{
+				"state":       state,
+				"description": description,
+				"context":     fmt.Sprintf("%s/%s", g.context, cluster.Cluster),
+			}, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", cluster.Cluster, err)
+		}
+	}
+	return nil
+}
+
+// reportDeployment creates a deployment of the commit to the environment named after the cluster and sets its status
+func (g *GithubReporter) reportDeployment(summary EventSummary, cluster ClusterSummary, state string, description string) error {
+	var deployment struct {
+		Id int64 `json:"id"`
+	}
+	err := g.post(fmt.Sprintf("/repos/%s/deployments", summary.Repository), map[string]interface{}{
+		"ref":               summary.Revision,
+		"environment":       cluster.Cluster,
+		"description":       truncate(fmt.Sprintf("%s:%s", summary.Source, summary.Tag), githubDescriptionLimit),
+		"auto_merge":        false,
+		"required_contexts": []string{},
+		"payload":           map[string]string{"eventId": summary.EventId, "tag": summary.Tag},
+	}, &deployment)
+	if err != nil {
+		return err
+	}
+
+	return g.post(fmt.Sprintf("/repos/%s/deployments/%d/statuses", summary.Repository, deployment.Id), map[string]string{
+		"state":       state,
+		"description": description,
+		"environment": cluster.Cluster,
+	}, nil)
+}
+
+// clusterStatus returns the state and description of the outcome in the cluster,
+// states of commit statuses are a subset of deployment states
+func clusterStatus(summary EventSummary, cluster ClusterSummary) (string, string) {
+	if !cluster.Reported {
+		return "success", fmt.Sprintf("Delivered %s, results not reported", summary.Tag)
+	}
+
+	var failed []string
+	for _, result := range cluster.Results {
+		if result.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s %s/%s", result.Kind, result.Namespace, result.Name))
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		return "failure", truncate(fmt.Sprintf("Failed to reconcile %s", strings.Join(failed, ", ")), githubDescriptionLimit)
+	case len(cluster.Results) == 0:
+		return "success", fmt.Sprintf("No objects use %s", summary.Tag)
+	}
+	return "success", fmt.Sprintf("Reconciled %d objects for %s", len(cluster.Results), summary.Tag)
+}
+
+func (g *GithubReporter) post(path string, payload interface{}, response interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+func truncate(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	return value[:limit-3] + "..."
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	sourceController "github.com/fluxcd/source-controller/api/v1beta2"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// githubRequest is a request received by the fake GitHub API
+type githubRequest struct {
+	path string
+	body map[string]interface{}
+}
+
+func TestGithubReporter(t *testing.T) {
+	summary := EventSummary{
+		EventId:    "event",
+		Source:     "oci://ghcr.io/org/app",
+		Tag:        "v1",
+		Repository: "org/app",
+		Revision:   "abc123",
+		Clusters: []ClusterSummary{
+			{Cluster: "production", Reported: true, Results: []ReconcileResult{
+				{Kind: kindOCIRepository, Namespace: "default", Name: "app", Error: "forbidden"},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		kind    string
+		summary EventSummary
+		// status the fake API responds with, 201 by default
+		status  int
+		want    []githubRequest
+		wantErr bool
+	}{
+		{
+			name:    "commit status",
+			kind:    githubStatusCommit,
+			summary: summary,
+			want: []githubRequest{
+				{path: "/repos/org/app/statuses/abc123", body: map[string]interface{}{
+					"state":       "failure",
+					"description": "Failed to reconcile OCIRepository default/app",
+					"context":     "flux-webhook-autoreconciler/production",
+				}},
+			},
+		},
+		{
+			name:    "deployment",
+			kind:    githubStatusDeployment,
+			summary: summary,
+			want: []githubRequest{
+				{path: "/repos/org/app/deployments", body: map[string]interface{}{
+					"ref":               "abc123",
+					"environment":       "production",
+					"description":       "oci://ghcr.io/org/app:v1",
+					"auto_merge":        false,
+					"required_contexts": []interface{}{},
+					"payload":           map[string]interface{}{"eventId": "event", "tag": "v1"},
+				}},
+				{path: "/repos/org/app/deployments/42/statuses", body: map[string]interface{}{
+					"state":       "failure",
+					"description": "Failed to reconcile OCIRepository default/app",
+					"environment": "production",
+				}},
+			},
+		},
+		{
+			name: "unknown commit",
+			kind: githubStatusCommit,
+			summary: EventSummary{EventId: "event", Tag: "v1", Clusters: []ClusterSummary{
+				{Cluster: "production"},
+			}},
+		},
+		{
+			name:    "API error",
+			kind:    githubStatusCommit,
+			summary: summary,
+			status:  http.StatusUnauthorized,
+			want: []githubRequest{
+				{path: "/repos/org/app/statuses/abc123", body: map[string]interface{}{
+					"state":       "failure",
+					"description": "Failed to reconcile OCIRepository default/app",
+					"context":     "flux-webhook-autoreconciler/production",
+				}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var m sync.Mutex
+			var requests []githubRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer token" {
+					t.Errorf("Authorization header %q, want the token", got)
+				}
+				var body map[string]interface{}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("invalid request body: %v", err)
+				}
+				m.Lock()
+				requests = append(requests, githubRequest{path: r.URL.Path, body: body})
+				m.Unlock()
+
+				status := test.status
+				if status == 0 {
+					status = http.StatusCreated
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(`{"id": 42}`))
+			}))
+			defer server.Close()
+
+			config := Config{}
+			config.GithubStatus.Enabled = true
+			config.GithubStatus.Type = test.kind
+			config.GithubStatus.APIURL = server.URL + "/"
+			config.GithubStatus.Token = "token"
+			config.GithubStatus.Context = defaultGithubStatusContext
+			err := NewGithubReporter(config, zap.NewNop()).Report(test.summary)
+
+			if (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %t", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(requests, test.want) {
+				t.Errorf("requests %+v, want %+v", requests, test.want)
+			}
+		})
+	}
+}
+
+func TestGithubStatusOnceAcrossReplicas(t *testing.T) {
+	repository := sourceController.OCIRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: kindOCIRepository, APIVersion: sourceController.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: sourceController.OCIRepositorySpec{
+			URL:       "oci://ghcr.io/org/app",
+			Reference: &sourceController.OCIRepositoryRef{Tag: "v1"},
+		},
+	}
+	event := SubscribeEventPayload{Id: "event", OciUrl: repository.Spec.URL, Tag: "v1", Repository: "org/app", Revision: "abc123"}
+
+	var m sync.Mutex
+	var contexts []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		m.Lock()
+		contexts = append(contexts, body["context"])
+		m.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// replica 0 leads and reconciles the event the follower received
+	bus := &sharedBus{}
+	var replicas [2]*Handlers
+	for i := range replicas {
+		leader := &LeaderElector{logger: zap.NewNop()}
+		leader.setLeading(i == 0)
+		config := Config{InstanceId: []string{"replica-0", "replica-1"}[i]}
+		config.Notifications.Window = time.Minute
+		config.GithubStatus.Enabled = true
+		config.GithubStatus.Type = githubStatusCommit
+		config.GithubStatus.APIURL = server.URL + "/"
+		config.GithubStatus.Token = "token"
+		config.GithubStatus.Context = defaultGithubStatusContext
+		client, _ := fakeSourceAPI(t, repository)
+		reconciler := NewReconciler(config, client, nil, nil, nil, leader, zap.NewNop())
+		replicas[i] = NewHandlers(config, reconciler, nil, nil, zap.NewNop())
+		bus.join(replicas[i])
+	}
+
+	replicas[1].dispatch(event, true)
+	for i := range replicas {
+		if err := replicas[i].notifier.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []interface{}{defaultGithubStatusContext + "/local"}
+	if !reflect.DeepEqual(contexts, want) {
+		t.Errorf("sent statuses with contexts %v, want %v", contexts, want)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	autoreconcilerv1 "flux-webhook-autoreconciler/api/v1"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// grpcServer implements the gRPC API on top of the handlers, so gRPC subscribers share
+// the registry, authentication and filtering with subscribers of the other transports
+type grpcServer struct {
+	autoreconcilerv1.UnimplementedSubscriberServiceServer
+	autoreconcilerv1.UnimplementedAdminServiceServer
+
+	handlers *Handlers
+	logger   *zap.Logger
+}
+
+// serveGRPC runs the gRPC server until the context is done
+func serveGRPC(ctx context.Context, config Config, handlers *Handlers, logger *zap.Logger) {
+	addr := fmt.Sprintf("%s:%s", config.GRPC.Host, config.GRPC.Port)
+
+	tlsConfig, err := serverTLSConfig(config, logger)
+	if err != nil {
+		logger.Fatal("Failed to load TLS config", zap.Error(err))
+	}
+	var options []grpc.ServerOption
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(options...)
+	api := &grpcServer{handlers: handlers, logger: logger}
+	autoreconcilerv1.RegisterSubscriberServiceServer(server, api)
+	autoreconcilerv1.RegisterAdminServiceServer(server, api)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Fatal("Failed to listen for gRPC", zap.Error(err))
+	}
+
+	go func() {
+		logger.Info("Starting gRPC server", zap.String("addr", addr), zap.Bool("tls", tlsConfig != nil))
+		if err := server.Serve(listener); err != nil {
+			logger.Fatal("Failed to start gRPC server", zap.Error(err))
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down gRPC server")
+	server.GracefulStop()
+}
+
+// Subscribe registers the stream as a subscriber, sending it events and processing hellos, acks and results it sends
+func (g *grpcServer) Subscribe(stream autoreconcilerv1.SubscriberService_SubscribeServer) error {
+	ctx := stream.Context()
+
+	var verifiedChains [][]*x509.Certificate
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			verifiedChains = info.State.VerifiedChains
+		}
+	}
+	subscr, err := g.handlers.newSubscriber(bearerToken(ctx), false, verifiedChains, transportGRPC)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+	if !g.handlers.connect() {
+		return status.Error(codes.Unavailable, goingAwayReason)
+	}
+	defer g.handlers.active.Done()
+
+	g.handlers.RegisterClient(subscr)
+	defer func() {
+		g.handlers.UnregisterClient(subscr)
+		g.logger.Info("Unregistered subscr", zap.String("clientId", subscr.id))
+	}()
+	g.logger.Info("Registered subscr", zap.String("clientId", subscr.id))
+
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- g.readRequests(stream, subscr)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-g.handlers.shutdown:
+			return status.Error(codes.Unavailable, goingAwayReason)
+		case <-subscr.revoked:
+			return status.Error(codes.Unauthenticated, revokedReason)
+		case err := <-readDone:
+			return err
+		case event := <-subscr.send:
+			ctx, span := tracer.Start(event.traceContext(), "grpcServer.SendEvent", eventAttributes(event),
+				trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attribute.String("client.id", subscr.id)))
+			response := &autoreconcilerv1.SubscribeResponse{
+				Message: &autoreconcilerv1.SubscribeResponse_Event{Event: eventToProto(event.withTraceContext(ctx))},
+			}
+			err := stream.Send(response)
+			endSpan(span, err)
+			if err != nil {
+				g.logger.Error("Error writing message", zap.Error(err), zap.String("clientId", subscr.id))
+				return err
+			}
+			subscr.sent(event)
+			g.logger.Info("Sent message", zap.String("clientId", subscr.id))
+		}
+	}
+}
+
+// readRequests processes messages sent by the subscriber until the stream ends
+func (g *grpcServer) readRequests(stream autoreconcilerv1.SubscriberService_SubscribeServer, subscr *Subscriber) error {
+	for {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			g.logger.Info("Subscriber connection closed", zap.Error(err), zap.String("clientId", subscr.id))
+			return err
+		}
+
+		switch message := request.Message.(type) {
+		case *autoreconcilerv1.SubscribeRequest_Hello:
+			hello := helloFromProto(message.Hello)
+			if err := hello.Filters.Validate(); err != nil {
+				g.logger.Warn("Received invalid subscription filters", zap.Error(err), zap.String("clientId", subscr.id))
+				continue
+			}
+			subscr.announce(hello)
+			g.logger.Info("Subscriber announced itself", zap.String("clientId", subscr.id), zap.String("cluster", hello.Cluster), zap.Stringer("filters", hello.Filters))
+		case *autoreconcilerv1.SubscribeRequest_Ack:
+			g.logger.Debug("Subscriber acknowledged event", zap.String("clientId", subscr.id), zap.String("eventId", message.Ack.EventId))
+		case *autoreconcilerv1.SubscribeRequest_Result:
+			g.handlers.recordResults(subscr, resultFromProto(message.Result))
+		default:
+			g.logger.Info("Received unknown message from subscr", zap.String("clientId", subscr.id))
+		}
+	}
+}
+
+// ListSubscribers lists connected subscribers, it requires the admin token
+func (g *grpcServer) ListSubscribers(ctx context.Context, _ *autoreconcilerv1.ListSubscribersRequest) (*autoreconcilerv1.ListSubscribersResponse, error) {
+	adminToken := g.handlers.config().GRPC.AdminToken
+	if adminToken == "" {
+		return nil, status.Error(codes.PermissionDenied, "admin API is disabled")
+	}
+	if !secureCompare(bearerToken(ctx), adminToken) {
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+
+	response := &autoreconcilerv1.ListSubscribersResponse{}
+	for _, info := range g.handlers.subscriberInfos() {
+		response.Subscribers = append(response.Subscribers, &autoreconcilerv1.Subscriber{
+			Id:          info.Id,
+			Name:        info.Name,
+			Transport:   info.Transport,
+			Cluster:     info.Cluster,
+			Filters:     filtersToProto(info.Filters),
+			ConnectedAt: timestamppb.New(info.ConnectedAt),
+		})
+	}
+	return response, nil
+}
+
+// bearerToken returns the token from the authorization metadata of the call
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		if token, found := strings.CutPrefix(value, "Bearer "); found {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+func eventToProto(event SubscribeEventPayload) *autoreconcilerv1.Event {
+	var receivedAt *timestamppb.Timestamp
+	if event.ReceivedAt != nil {
+		receivedAt = timestamppb.New(*event.ReceivedAt)
+	}
+	return &autoreconcilerv1.Event{
+		Id:           event.Id,
+		OciUrl:       event.OciUrl,
+		Tag:          event.Tag,
+		Provider:     event.Provider,
+		Namespaces:   event.Namespaces,
+		Hops:         event.Hops,
+		TraceContext: event.TraceContext,
+		ReceivedAt:   receivedAt,
+		Repository:   event.Repository,
+		Revision:     event.Revision,
+	}
+}
+
+func eventFromProto(event *autoreconcilerv1.Event) SubscribeEventPayload {
+	var receivedAt *time.Time
+	if event.GetReceivedAt() != nil {
+		t := event.GetReceivedAt().AsTime()
+		receivedAt = &t
+	}
+	return SubscribeEventPayload{
+		Id:           event.GetId(),
+		OciUrl:       event.GetOciUrl(),
+		Tag:          event.GetTag(),
+		Provider:     event.GetProvider(),
+		Namespaces:   event.GetNamespaces(),
+		Hops:         event.GetHops(),
+		TraceContext: event.GetTraceContext(),
+		ReceivedAt:   receivedAt,
+		Repository:   event.GetRepository(),
+		Revision:     event.GetRevision(),
+	}
+}
+
+func filtersToProto(filters SubscriptionFilters) *autoreconcilerv1.SubscriptionFilters {
+	return &autoreconcilerv1.SubscriptionFilters{
+		UrlPrefixes: filters.URLPrefixes,
+		UrlGlobs:    filters.URLGlobs,
+		Tags:        filters.Tags,
+	}
+}
+
+func helloFromProto(hello *autoreconcilerv1.Hello) HelloMessage {
+	filters := hello.GetFilters()
+	return HelloMessage{
+		Type:    messageTypeHello,
+		Cluster: hello.GetCluster(),
+		Filters: SubscriptionFilters{
+			URLPrefixes: filters.GetUrlPrefixes(),
+			URLGlobs:    filters.GetUrlGlobs(),
+			Tags:        filters.GetTags(),
+		},
+	}
+}
+
+func resultsToProto(eventId string, results []ReconcileResult) *autoreconcilerv1.Result {
+	result := &autoreconcilerv1.Result{EventId: eventId}
+	for _, object := range results {
+		result.Objects = append(result.Objects, &autoreconcilerv1.ObjectResult{
+			Kind:      object.Kind,
+			Namespace: object.Namespace,
+			Name:      object.Name,
+			Error:     object.Error,
+		})
+	}
+	return result
+}
+
+func resultFromProto(result *autoreconcilerv1.Result) ResultMessage {
+	message := ResultMessage{EventId: result.GetEventId()}
+	for _, object := range result.GetObjects() {
+		message.Results = append(message.Results, ReconcileResult{
+			Kind:      object.GetKind(),
+			Namespace: object.GetNamespace(),
+			Name:      object.GetName(),
+			Error:     object.GetError(),
+		})
+	}
+	return message
+}
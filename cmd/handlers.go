@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -10,11 +12,15 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,17 +30,38 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Number of events buffered for a subscriber before dispatching blocks.
+	subscriberQueueSize = 100
+
+	// Time allowed to write a control message to the peer.
+	writeWait = time.Second
+
+	// Reason sent to subscribers when the server shuts down, gRPC clients recognize shutdown by it.
+	goingAwayReason = "server shutting down"
+
+	// Reason sent to subscribers disconnected because their credentials were revoked or expired.
+	revokedReason = "credentials revoked"
 )
 
+// Provider name of events coming from GitHub webhooks
+const providerGithub = "github"
+
 type RegistryPackagePayload struct {
 	Name           string `json:"name" validate:"required"`
 	Namespace      string `json:"namespace" validate:"required"`
 	PackageType    string `json:"package_type" validate:"required,eq=CONTAINER"`
 	PackageVersion struct {
+		// TargetOid is the commit the package was built from, if GitHub knows it
+		TargetOid         string `json:"target_oid"`
 		ContainerMetadata struct {
 			Tag struct {
 				Name string `json:"name" validate:"required"`
 			} `json:"tag" validate:"required"`
+			Labels struct {
+				// Revision is the org.opencontainers.image.revision label
+				Revision string `json:"revision"`
+			} `json:"labels"`
 		} `json:"container_metadata" validate:"required"`
 	} `json:"package_version" validate:"required"`
 }
@@ -51,55 +78,459 @@ type PingEventPayload struct {
 type ContainerPushPayload struct {
 	Action          string                 `json:"action" validate:"required,eq=published"`
 	RegistryPackage RegistryPackagePayload `json:"registry_package"`
+	// Repository is the repository the package is linked to, if any
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// revision returns the commit the pushed image was built from, or an empty string if it is unknown
+func (p ContainerPushPayload) revision() string {
+	if p.RegistryPackage.PackageVersion.TargetOid != "" {
+		return p.RegistryPackage.PackageVersion.TargetOid
+	}
+	return p.RegistryPackage.PackageVersion.ContainerMetadata.Labels.Revision
 }
 
 type SubscribeEventPayload struct {
-	OciUrl string `json:"oci_url"`
-	Tag    string `json:"tag"`
+	// Id identifies the event across servers, relays and clients
+	Id       string `json:"id,omitempty"`
+	OciUrl   string `json:"oci_url"`
+	Tag      string `json:"tag"`
+	Provider string `json:"provider,omitempty"`
+
+	// Namespaces restricts reconciliation to sources of these namespaces, empty means all namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Hops are IDs of servers and relays the event passed through
+	Hops []string `json:"hops,omitempty"`
+
+	// Repository and Revision are the source repository ("owner/name") and commit of the pushed image, if known
+	Repository string `json:"repository,omitempty"`
+	Revision   string `json:"revision,omitempty"`
+
+	// ReceivedAt is when the first server received the webhook, used to measure end-to-end latency
+	ReceivedAt *time.Time `json:"received_at,omitempty"`
+
+	// TraceContext is the W3C trace context of the event, it is sent in the envelope rather than the payload
+	TraceContext map[string]string `json:"-"`
+}
+
+// sinceReceived returns the time passed since the webhook of the event was received, events from older servers don't carry it
+func (e SubscribeEventPayload) sinceReceived() (time.Duration, bool) {
+	if e.ReceivedAt == nil {
+		return 0, false
+	}
+	return time.Since(*e.ReceivedAt), true
+}
+
+// provider returns the event provider, events from older servers don't carry it and always come from GitHub
+func (e SubscribeEventPayload) provider() string {
+	if e.Provider == "" {
+		return providerGithub
+	}
+	return e.Provider
+}
+
+// origin returns the ID of the instance that dispatched the event last, for events from the event bus
+// the replica that received the webhook. Events from older servers without hops have no origin.
+func (e SubscribeEventPayload) origin() string {
+	if len(e.Hops) == 0 {
+		return ""
+	}
+	return e.Hops[len(e.Hops)-1]
 }
 
 type Subscriber struct {
-	id         string
+	id   string
+	name string
+	// identity is the name of the credential the subscriber authenticated with
+	identity string
+	// token is the credential the subscriber authenticated with, checked again when the config is reloaded
+	token      string
+	transport  string
+	registries []string
+	namespaces []string
 	connection *websocket.Conn
 	send       chan SubscribeEventPayload
+	done       chan struct{}
+	// messages the WebSocket writer sends besides events, e.g. the welcome message
+	replies chan []byte
+	// closed when the credentials of the subscriber no longer authenticate, its transport disconnects it then
+	revoked    chan struct{}
+	revokeOnce sync.Once
+	// expiresAt is when the JWT of the subscriber expires, zero for credentials without expiration
+	expiresAt time.Time
+	expiry    *time.Timer
+
+	connectedAt time.Time
+	cluster     string
+	filters     SubscriptionFilters
+	// negotiated protocol version and features, version 0 until the client announces supported versions
+	version  int
+	features []string
+	m        sync.Mutex
+}
+
+// SubscriberInfo is the admin representation of a connected subscriber
+type SubscriberInfo struct {
+	Id          string              `json:"id"`
+	Name        string              `json:"name"`
+	Transport   string              `json:"transport"`
+	Cluster     string              `json:"cluster,omitempty"`
+	Filters     SubscriptionFilters `json:"filters"`
+	ConnectedAt time.Time           `json:"connectedAt"`
+	Version     int                 `json:"protocolVersion"`
+	Features    []string            `json:"features,omitempty"`
+}
+
+// announce applies the cluster name and filters from the client's hello message
+func (s *Subscriber) announce(hello HelloMessage) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.cluster = hello.Cluster
+	s.filters = hello.Filters
+}
+
+func (s *Subscriber) info() SubscriberInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return SubscriberInfo{Id: s.id, Name: s.name, Transport: s.transport, Cluster: s.cluster, Filters: s.filters, ConnectedAt: s.connectedAt, Version: s.version, Features: s.features}
+}
+
+// negotiate agrees on the protocol version and features with the client
+func (s *Subscriber) negotiate(hello HelloMessage) WelcomeMessage {
+	welcome := negotiate(hello, transportFeatures[s.transport])
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.version = welcome.Version
+	s.features = welcome.Features
+	return welcome
+}
+
+func (s *Subscriber) negotiatedVersion() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.version
+}
+
+// revoke tells the transport of the subscriber to disconnect it
+func (s *Subscriber) revoke() {
+	s.revokeOnce.Do(func() {
+		close(s.revoked)
+	})
+}
+
+func (s *Subscriber) isRevoked() bool {
+	select {
+	case <-s.revoked:
+		return true
+	default:
+		return false
+	}
+}
+
+// clusterName returns the cluster the client announced, or the client name if it didn't announce one
+func (s *Subscriber) clusterName() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cluster == "" {
+		return s.name
+	}
+	return s.cluster
+}
+
+// reportsResults reports whether the client reports reconciliation results of events, gRPC clients always do
+func (s *Subscriber) reportsResults() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.transport == transportGRPC || contains(s.features, featureResults)
+}
+
+// sent records metrics of an event sent to the subscriber
+func (s *Subscriber) sent(event SubscribeEventPayload) {
+	if latency, ok := event.sinceReceived(); ok {
+		fanoutLatency.With(prometheus.Labels{"client": s.name, "transport": s.transport}).Observe(latency.Seconds())
+	}
+	s.updateQueueDepth()
+}
+
+func (s *Subscriber) updateQueueDepth() {
+	subscriberQueueDepth.With(prometheus.Labels{"client_id": s.id, "client": s.name}).Set(float64(len(s.send)))
+}
+
+// encode encodes the event in the negotiated protocol version
+func (s *Subscriber) encode(event SubscribeEventPayload) ([]byte, error) {
+	return encodeEvent(s.negotiatedVersion(), event)
+}
+
+// welcomeEnvelope wraps the welcome message into an envelope of the negotiated version
+func welcomeEnvelope(welcome WelcomeMessage) (Envelope, error) {
+	return newEnvelope(welcome.Version, messageTypeWelcome, "", welcome)
+}
+
+// accepts reports whether the subscriber may receive the event and returns the event
+// with its namespaces narrowed down to the ones the subscriber is allowed to reconcile
+func (s *Subscriber) accepts(event SubscribeEventPayload) (SubscribeEventPayload, bool) {
+	s.m.Lock()
+	filters := s.filters
+	s.m.Unlock()
+	if !filters.Matches(event) {
+		return event, false
+	}
+
+	if len(s.registries) > 0 {
+		image := strings.TrimPrefix(event.OciUrl, "oci://")
+		allowed := false
+		for _, registry := range s.registries {
+			if inRegistry(image, registry) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return event, false
+		}
+	}
+
+	if len(s.namespaces) == 0 {
+		return event, true
+	}
+	if len(event.Namespaces) == 0 {
+		event.Namespaces = s.namespaces
+		return event, true
+	}
+
+	var namespaces []string
+	for _, namespace := range event.Namespaces {
+		if contains(s.namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	event.Namespaces = namespaces
+	return event, len(namespaces) > 0
+}
+
+// inRegistry reports whether the image is the registry prefix itself or below it on a path boundary,
+// so that ghcr.io/codex-team doesn't grant access to ghcr.io/codex-team-other
+func inRegistry(image string, registry string) bool {
+	return image == registry || strings.HasPrefix(image, strings.TrimSuffix(registry, "/")+"/")
+}
+
+// activeConfig is the config of the handlers and the JWT verifier derived from it, replaced together on reload
+type activeConfig struct {
+	Config
+	// jwtVerifier is nil without JWT settings
+	jwtVerifier *jwtVerifier
+}
+
+func newActiveConfig(config Config) *activeConfig {
+	active := &activeConfig{Config: config}
+	if config.JWT.HMACKey != "" || config.JWT.JWKSFile != "" {
+		active.jwtVerifier = newJWTVerifier(config)
+	}
+	return active
 }
 
 type Handlers struct {
-	config      Config
-	reconciler  *Reconciler
+	current    atomic.Pointer[activeConfig]
+	reconciler *Reconciler
+	tenants    *TenantWebhooks
+	bus        EventBus
+	notifier   *Notifier
+	// audit is nil without the audit log
+	audit       *AuditLog
 	validate    *validator.Validate
 	upgrader    websocket.Upgrader
 	logger      *zap.Logger
 	subscribers map[*Subscriber]bool
-	m           sync.Mutex
+	// long-poll subscribers by session ID
+	pollSessions map[string]*pollSession
+	m            sync.Mutex
+
+	// set when the server starts shutting down, new webhooks and events are rejected from then on
+	stopping bool
+	// webhooks and events being dispatched, subscribers are told to go away once they are handled
+	dispatching sync.WaitGroup
+	// closed when subscribers are told to go away
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// WebSocket connections, SSE and gRPC streams, closed once subscribers are told to go away
+	active sync.WaitGroup
 }
 
-func NewHandlers(config Config, reconciler *Reconciler, logger *zap.Logger) *Handlers {
+func NewHandlers(config Config, reconciler *Reconciler, tenants *TenantWebhooks, audit *AuditLog, logger *zap.Logger) *Handlers {
 	validate := validator.New(validator.WithRequiredStructEnabled())
 	subscribers := make(map[*Subscriber]bool)
-	return &Handlers{
-		config:      config,
-		reconciler:  reconciler,
-		validate:    validate,
-		upgrader:    websocket.Upgrader{},
-		subscribers: subscribers,
-		logger:      logger,
+	handlers := &Handlers{
+		reconciler:   reconciler,
+		tenants:      tenants,
+		validate:     validate,
+		upgrader:     websocket.Upgrader{},
+		subscribers:  subscribers,
+		pollSessions: make(map[string]*pollSession),
+		shutdown:     make(chan struct{}),
+		audit:        audit,
+		logger:       logger,
 	}
+	handlers.notifier = NewNotifier(config, handlers.forwardReport, logger)
+	handlers.current.Store(newActiveConfig(config))
+	handlers.bus = newEventBus(config, handlers.receive, handlers.receiveReport, logger)
+	return handlers
 }
 
-func (s *Handlers) Subscribe(w http.ResponseWriter, r *http.Request) {
+// config returns the active config
+func (s *Handlers) config() *activeConfig {
+	return s.current.Load()
+}
+
+// Reload applies secrets and notifications of the reloaded config. Connected subscribers stay connected,
+// unless their credentials don't authenticate with the new secrets, e.g. revoked tokens.
+func (s *Handlers) Reload(config Config) {
+	s.current.Store(newActiveConfig(config))
+	s.notifier.Reload(config)
+	s.revokeSubscribers()
+}
+
+// revokeSubscribers disconnects subscribers whose credentials no longer authenticate with the active config
+func (s *Handlers) revokeSubscribers() {
+	config := s.config()
+	s.m.Lock()
+	subscribers := make([]*Subscriber, 0, len(s.subscribers))
+	for subscr := range s.subscribers {
+		subscribers = append(subscribers, subscr)
+	}
+	s.m.Unlock()
+
+	for _, subscr := range subscribers {
+		if _, err := authenticateSubscriber(config.Config, config.jwtVerifier, subscr.token); err != nil {
+			s.logger.Info("Disconnecting subscriber with revoked credentials", zap.Error(err), zap.String("clientId", subscr.id), zap.String("clientName", subscr.name))
+			subscr.revoke()
+		}
+	}
+}
+
+// Shutdown rejects new webhooks and events and waits until those being dispatched are handled,
+// so subscribers still receive them. Then it tells subscribers the server is going away
+// and waits until their connections are closed, or the context is done.
+func (s *Handlers) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	s.stopping = true
+	s.m.Unlock()
+	err := waitContext(ctx, &s.dispatching)
+
+	s.m.Lock()
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+	s.m.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := waitContext(ctx, &s.active); err != nil {
+		return err
+	}
+	// results of clients that disconnected won't arrive anymore
+	return s.notifier.Flush(ctx)
+}
+
+// startDispatch registers a webhook or event being dispatched, unless the server is shutting down
+func (s *Handlers) startDispatch() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.dispatching.Add(1)
+	return true
+}
+
+// connect registers a subscriber connection, unless subscribers were told to go away already
+func (s *Handlers) connect() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	select {
+	case <-s.shutdown:
+		return false
+	default:
+	}
+	s.active.Add(1)
+	return true
+}
+
+// authenticate authenticates the subscription request and creates a subscriber for it.
+// If authentication fails, it responds with an error and returns false.
+func (s *Handlers) authenticate(w http.ResponseWriter, r *http.Request, transport string) (*Subscriber, bool) {
+	token, fromQuery := subscriberCredentials(r)
+	var verifiedChains [][]*x509.Certificate
+	if r.TLS != nil {
+		verifiedChains = r.TLS.VerifiedChains
+	}
+	subscr, err := s.newSubscriber(token, fromQuery, verifiedChains, transport)
+	if err != nil {
+		http.Error(w, "Invalid auth secret", http.StatusUnauthorized)
+		return nil, false
+	}
+	return subscr, true
+}
+
+// newSubscriber authenticates the token and creates a subscriber for the transport.
+// A verified client certificate, if any, names the subscriber.
+func (s *Handlers) newSubscriber(token string, fromQuery bool, verifiedChains [][]*x509.Certificate, transport string) (*Subscriber, error) {
 	clientUuid := uuid.New()
 	clientId := clientUuid.String()
-	s.logger.Info("Handling new subscription", zap.String("clientId", clientId))
+	s.logger.Info("Handling new subscription", zap.String("clientId", clientId), zap.String("transport", transport))
 
-	if s.config.SubscribeSecret != "" {
-		authSecret := r.URL.Query().Get("authSecret")
-		if authSecret != s.config.SubscribeSecret {
-			s.logger.Info("Invalid auth secret from subscr", zap.String("clientId", clientId))
-			http.Error(w, "Invalid auth secret", http.StatusUnauthorized)
-			return
-		}
+	config := s.config()
+	identity, err := authenticateSubscriber(config.Config, config.jwtVerifier, token)
+	if err != nil {
+		s.logger.Warn("Subscriber authentication failed", zap.Error(err), zap.String("clientId", clientId))
+		return nil, err
+	}
+	clientName := identity.Name
+	if len(verifiedChains) > 0 {
+		// verified client certificate identifies the subscriber more precisely than a shared secret
+		clientName = verifiedChains[0][0].Subject.CommonName
+	}
+	subscriptionsTotal.With(prometheus.Labels{"client": clientName}).Inc()
+	if fromQuery && token != "" {
+		s.logger.Warn("Subscriber authenticated with deprecated authSecret query parameter, use Authorization header instead", zap.String("clientId", clientId), zap.String("clientName", clientName))
 	}
+	s.logger.Info("Subscriber authenticated", zap.String("clientId", clientId), zap.String("clientName", clientName))
+
+	return &Subscriber{
+		send:       make(chan SubscribeEventPayload, subscriberQueueSize),
+		done:       make(chan struct{}),
+		replies:    make(chan []byte, 1),
+		revoked:    make(chan struct{}),
+		id:         clientId,
+		name:       clientName,
+		identity:   identity.Name,
+		token:      token,
+		transport:  transport,
+		registries: identity.Registries,
+		namespaces: identity.Namespaces,
+		expiresAt:  identity.ExpiresAt,
+
+		connectedAt: time.Now(),
+	}, nil
+}
+
+func (s *Handlers) Subscribe(w http.ResponseWriter, r *http.Request) {
+	subscr, ok := s.authenticate(w, r, transportWebsocket)
+	if !ok {
+		return
+	}
+	clientId := subscr.id
+
+	if !s.connect() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.active.Done()
 
 	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -108,8 +539,7 @@ func (s *Handlers) Subscribe(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
-	sendChan := make(chan SubscribeEventPayload)
-	subscr := &Subscriber{connection: c, send: sendChan, id: clientId}
+	subscr.connection = c
 	s.RegisterClient(subscr)
 	defer func() {
 		s.UnregisterClient(subscr)
@@ -126,28 +556,56 @@ func (s *Handlers) Subscribe(w http.ResponseWriter, r *http.Request) {
 		return c.SetReadDeadline(time.Now().Add(pongWait))
 	})
 
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		s.readMessages(subscr)
+	}()
+
 	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case message, more := <-subscr.send:
-			if !more {
-				s.logger.Info("Subscriber send channel closed", zap.String("clientId", clientId))
-				break
+		case <-readDone:
+			return
+		case <-s.shutdown:
+			// clients reconnect to another replica right away on going away
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, goingAwayReason)
+			if err := c.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+				s.logger.Error("Error writing close message", zap.Error(err), zap.String("clientId", clientId))
 			}
-
-			buff, err := json.Marshal(message)
+			return
+		case <-subscr.revoked:
+			message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, revokedReason)
+			if err := c.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+				s.logger.Error("Error writing close message", zap.Error(err), zap.String("clientId", clientId))
+			}
+			return
+		case reply := <-subscr.replies:
+			if err := c.WriteMessage(websocket.TextMessage, reply); err != nil {
+				s.logger.Error("Error writing message", zap.Error(err), zap.String("clientId", clientId))
+				return
+			}
+		case message := <-subscr.send:
+			ctx, span := tracer.Start(message.traceContext(), "Handlers.SendWebsocket", eventAttributes(message),
+				trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attribute.String("client.id", clientId)))
+			buff, err := subscr.encode(message.withTraceContext(ctx))
 			if err != nil {
 				s.logger.Error("Error marshalling message", zap.Error(err), zap.String("clientId", clientId))
+				endSpan(span, err)
 				break
 			}
 
+			// events are binary frames in every protocol version, clients of the legacy protocol ignore other frames
 			err = c.WriteMessage(websocket.BinaryMessage, buff)
+			endSpan(span, err)
 
 			if err != nil {
 				s.logger.Error("Error writing message", zap.Error(err), zap.String("clientId", clientId))
-				break
+				return
 			}
+			subscr.sent(message)
 			s.logger.Info("Sent message", zap.String("clientId", clientId))
 		case <-ticker.C:
 			if err := c.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
@@ -158,66 +616,382 @@ func (s *Handlers) Subscribe(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Handlers) HandleContainerPushPayload(payload ContainerPushPayload) {
+// readMessages reads messages sent by the subscriber until the connection fails.
+// Reading also processes pongs, which keep the connection alive.
+func (s *Handlers) readMessages(subscr *Subscriber) {
+	for {
+		messageType, message, err := subscr.connection.ReadMessage()
+		if err != nil {
+			s.logger.Info("Subscriber connection closed", zap.Error(err), zap.String("clientId", subscr.id))
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		if envelope, ok := parseEnvelope(message); ok {
+			s.processEnvelope(subscr, envelope)
+			continue
+		}
+
+		var hello HelloMessage
+		if err := json.Unmarshal(message, &hello); err != nil || hello.Type != messageTypeHello {
+			s.logger.Info("Received unknown message from subscr", zap.String("clientId", subscr.id), zap.String("message", string(message)))
+			continue
+		}
+		if err := hello.Filters.Validate(); err != nil {
+			s.logger.Warn("Received invalid subscription filters", zap.Error(err), zap.String("clientId", subscr.id))
+			continue
+		}
+
+		subscr.announce(hello)
+		s.logger.Info("Subscriber announced itself", zap.String("clientId", subscr.id), zap.String("cluster", hello.Cluster), zap.Stringer("filters", hello.Filters))
+
+		welcome := subscr.negotiate(hello)
+		if welcome.Version == 0 {
+			continue
+		}
+		envelope, err := welcomeEnvelope(welcome)
+		if err != nil {
+			s.logger.Error("Error marshalling message", zap.Error(err), zap.String("clientId", subscr.id))
+			continue
+		}
+		buff, err := json.Marshal(envelope)
+		if err != nil {
+			s.logger.Error("Error marshalling message", zap.Error(err), zap.String("clientId", subscr.id))
+			continue
+		}
+		select {
+		case subscr.replies <- buff:
+		case <-subscr.done:
+			return
+		}
+		s.logger.Info("Negotiated protocol", zap.String("clientId", subscr.id), zap.Int("version", welcome.Version), zap.Strings("features", welcome.Features))
+	}
+}
+
+// processEnvelope handles an enveloped message from the subscriber, ignoring message types it doesn't know
+func (s *Handlers) processEnvelope(subscr *Subscriber, envelope Envelope) {
+	switch envelope.Type {
+	case messageTypeResult:
+		var result ResultMessage
+		if err := json.Unmarshal(envelope.Payload, &result); err != nil {
+			s.logger.Warn("Received invalid result message", zap.Error(err), zap.String("clientId", subscr.id))
+			return
+		}
+		s.recordResults(subscr, result)
+	default:
+		s.logger.Debug("Ignoring message of unknown type", zap.String("clientId", subscr.id), zap.String("type", envelope.Type))
+	}
+}
+
+// recordResults records reconciliation results reported by the subscriber
+func (s *Handlers) recordResults(subscr *Subscriber, result ResultMessage) {
+	for _, object := range result.Results {
+		resultStatus := "success"
+		if object.Error != "" {
+			resultStatus = "fail"
+		}
+		subscriberResults.With(prometheus.Labels{"client": subscr.name, "status": resultStatus}).Inc()
+		s.logger.Info("Subscriber reported result", zap.String("clientId", subscr.id), zap.String("eventId", result.EventId),
+			zap.String("kind", object.Kind), zap.String("namespace", object.Namespace), zap.String("name", object.Name), zap.String("error", object.Error))
+	}
+	s.notifier.Report(result.EventId, subscr.id, result.Results)
+}
+
+// Subscribers lists connected subscribers with their clusters and filters
+func (s *Handlers) Subscribers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.subscriberInfos()); err != nil {
+		s.logger.Error("Error encoding subscribers", zap.Error(err))
+	}
+}
+
+func (s *Handlers) subscriberInfos() []SubscriberInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	infos := make([]SubscriberInfo, 0, len(s.subscribers))
+	for subscr := range s.subscribers {
+		infos = append(infos, subscr.info())
+	}
+	return infos
+}
+
+// HandleContainerPushPayload notifies subscribers and reconciles sources of the pushed package, if enabled.
+// Non-empty namespaces restrict reconciliation to sources of those namespaces.
+// It returns the dispatched event and the results of local reconciliation.
+func (s *Handlers) HandleContainerPushPayload(ctx context.Context, payload ContainerPushPayload, namespaces []string) (SubscribeEventPayload, []ReconcileResult) {
 	tag := payload.RegistryPackage.PackageVersion.ContainerMetadata.Tag.Name
 	ociUrl := fmt.Sprintf("oci://ghcr.io/%s/%s", payload.RegistryPackage.Namespace, payload.RegistryPackage.Name)
 	s.logger.Info("Handling container push payload", zap.String("ociUrl", ociUrl), zap.String("tag", tag))
 
+	receivedAt := time.Now().UTC()
+	event := SubscribeEventPayload{
+		Id:         uuid.New().String(),
+		OciUrl:     ociUrl,
+		Tag:        tag,
+		Provider:   providerGithub,
+		Namespaces: namespaces,
+		Repository: payload.Repository.FullName,
+		Revision:   payload.revision(),
+		ReceivedAt: &receivedAt,
+	}
+	ctx, span := tracer.Start(ctx, "Handlers.HandleContainerPushPayload", eventAttributes(event))
+	defer span.End()
+
+	return event, s.dispatch(event.withTraceContext(ctx), true)
+}
+
+// Dispatch handles an event received from an upstream server. Every replica of a relay receives
+// upstream events itself, so they are delivered to local subscribers only, not published to the event bus.
+func (s *Handlers) Dispatch(event SubscribeEventPayload) []ReconcileResult {
+	if !s.startDispatch() {
+		s.logger.Warn("Dropping upstream event, server is shutting down", zap.String("ociUrl", event.OciUrl))
+		return nil
+	}
+	defer s.dispatching.Done()
+	return s.dispatch(event, false)
+}
+
+// dispatch sends the event to matching subscribers and reconciles local sources if the reconciler is set.
+// Published events reach subscribers of all replicas through the event bus, local sources are reconciled
+// by the replica that received the event, or by the leader if it is a follower (see receive).
+// Every instance records its ID in the event hops, and events that already passed through this instance
+// are dropped, which prevents loops between relays. It returns results of the local reconciliation.
+// Callers register the dispatch with startDispatch.
+func (s *Handlers) dispatch(event SubscribeEventPayload, publish bool) []ReconcileResult {
+	instanceId := s.config().InstanceId
+	if contains(event.Hops, instanceId) {
+		s.logger.Warn("Dropping event that already passed through this instance", zap.String("ociUrl", event.OciUrl), zap.Strings("hops", event.Hops))
+		return nil
+	}
+	event.Hops = append(append([]string{}, event.Hops...), instanceId)
+	// followers leave the local cluster to the leader, so it is reported once
+	reconciles := s.reconciler != nil && s.reconciler.reconcilesLocally()
+	if reconciles {
+		s.notifier.Reached(event, instanceId, s.localCluster(), instanceId, true)
+	}
+
+	// subscribers of this replica get the event while the dispatch is registered, so it isn't lost on shutdown,
+	// the event bus only reaches other replicas, receive skips events published by this one
+	if publish {
+		if err := s.bus.Publish(event.traceContext(), event); err != nil {
+			// other replicas miss the event, but subscribers of this one still get it
+			s.logger.Error("Failed to publish event to the event bus", zap.Error(err), zap.String("ociUrl", event.OciUrl))
+		}
+	}
+	s.deliver(event)
+
+	if reconciles {
+		return s.reconcile(event, instanceId)
+	}
+	return nil
+}
+
+// receive handles an event other replicas published to the event bus. Besides delivering it to local subscribers,
+// the leader reconciles local sources, as followers skip reconciliation. Without leader election, the replica
+// that published the event reconciled it already. Events published by this replica were handled by dispatch.
+func (s *Handlers) receive(event SubscribeEventPayload) {
+	instanceId := s.config().InstanceId
+	if event.origin() == instanceId {
+		return
+	}
+	if !s.startDispatch() {
+		s.logger.Warn("Dropping event from the event bus, server is shutting down", zap.String("ociUrl", event.OciUrl))
+		return
+	}
+	defer s.dispatching.Done()
+
+	s.deliver(event)
+
+	if s.reconciler == nil || !s.reconciler.reconcilesForReplicas() {
+		return
+	}
+	s.notifier.Reached(event, instanceId, s.localCluster(), instanceId, true)
+	s.reconcile(event, instanceId)
+}
+
+// forwardReport publishes a report of an event to the replica that received its webhook
+func (s *Handlers) forwardReport(report ReportMessage) {
+	if err := s.bus.PublishReport(context.Background(), report); err != nil {
+		s.logger.Error("Failed to forward report to the event bus", zap.Error(err), zap.String("origin", report.Origin))
+	}
+}
+
+// receiveReport records a report other replicas forwarded for events whose webhook this replica received
+func (s *Handlers) receiveReport(report ReportMessage) {
+	if report.Origin != s.config().InstanceId {
+		return
+	}
+	if report.Event != nil {
+		s.notifier.Reached(*report.Event, report.Reporter, report.Cluster, report.Client, report.Reports)
+		return
+	}
+	s.notifier.Report(report.EventId, report.Reporter, report.Results)
+}
+
+// reconcile reconciles local sources and reports the results to the notifier
+func (s *Handlers) reconcile(event SubscribeEventPayload, instanceId string) []ReconcileResult {
+	results := s.reconciler.ReconcileSources(event)
+	s.notifier.Report(event.Id, instanceId, results)
+	return results
+}
+
+// localCluster names the cluster of this instance in notifications
+func (s *Handlers) localCluster() string {
+	if cluster := s.config().Cluster; cluster != "" {
+		return cluster
+	}
+	return "local"
+}
+
+// deliver sends the event to matching subscribers connected to this replica
+func (s *Handlers) deliver(event SubscribeEventPayload) {
+	// dead poll sessions would block dispatching once their queues are full
+	s.expirePollSessions()
+
+	s.m.Lock()
+	subscribers := make([]*Subscriber, 0, len(s.subscribers))
 	for subscr := range s.subscribers {
-		payload := SubscribeEventPayload{OciUrl: ociUrl, Tag: tag}
-		subscr.send <- payload
+		subscribers = append(subscribers, subscr)
 	}
+	s.m.Unlock()
 
-	s.reconciler.ReconcileSources(ociUrl, tag)
+	for _, subscr := range subscribers {
+		subscrEvent, ok := subscr.accepts(event)
+		if !ok {
+			continue
+		}
+		select {
+		case subscr.send <- subscrEvent:
+			subscr.updateQueueDepth()
+			s.notifier.Reached(event, subscr.id, subscr.clusterName(), subscr.name, subscr.reportsResults())
+		case <-subscr.done:
+		}
+	}
 }
 
 func (s *Handlers) Webhook(w http.ResponseWriter, r *http.Request) {
-	s.logger.Info("Handling webhook", zap.String("method", r.Method), zap.String("path", r.URL.Path))
+	config := s.config()
+	s.handleWebhook(w, r, config.HasGithubSecrets(), config.ActiveGithubSecrets(time.Now()), nil)
+}
+
+// TenantWebhook handles webhooks of a tenant endpoint, verifying them with the secret from the tenant's Kubernetes Secret
+func (s *Handlers) TenantWebhook(w http.ResponseWriter, r *http.Request) {
+	secret, namespaces, err := s.tenants.Secret(r.URL.Path)
+	if err != nil {
+		s.logger.Error("Failed to get webhook secret", zap.Error(err), zap.String("path", r.URL.Path))
+		http.Error(w, "Webhook secret is not available", http.StatusServiceUnavailable)
+		webhooksHandled.With(webhookLabels(r, "fail")).Inc()
+		audit := newAuditRecord(r)
+		audit.reject(http.StatusServiceUnavailable, "webhook secret is not available")
+		s.writeAudit(audit)
+		return
+	}
+	s.handleWebhook(w, r, true, []WebhookSecret{{Name: r.URL.Path, Secret: string(secret)}}, namespaces)
+}
+
+// handleWebhook verifies the signature with one of the secrets if signed is set, and dispatches the payload.
+// Signed requests are rejected when none of the secrets is active anymore. Every request is recorded in the audit log.
+func (s *Handlers) handleWebhook(w http.ResponseWriter, r *http.Request, signed bool, secrets []WebhookSecret, namespaces []string) {
+	ctx, span := tracer.Start(r.Context(), "Handlers.Webhook", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.target", r.URL.Path)))
+	defer span.End()
+
+	start := time.Now()
+	audit := newAuditRecord(r)
+	defer func() {
+		status := "success"
+		if audit.Outcome == auditRejected {
+			status = "fail"
+			span.SetStatus(codes.Error, audit.Reason)
+		}
+		labels := webhookLabels(r, status)
+		webhooksHandled.With(labels).Inc()
+		webhookDuration.With(labels).Observe(time.Since(start).Seconds())
+		s.writeAudit(audit)
+	}()
+
+	logger := s.logger.With(zap.String("path", r.URL.Path), zap.String("remoteIp", audit.RemoteIP), zap.String("deliveryId", audit.DeliveryId))
+	logger.Info("Handling webhook", zap.String("method", r.Method), zap.String("eventType", audit.EventType))
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		webhooksHandled.With(prometheus.Labels{"status": "fail"}).Inc()
+		audit.reject(http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
+	// rejected webhooks can be redelivered to another replica
+	if !s.startDispatch() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		audit.reject(http.StatusServiceUnavailable, "server shutting down")
+		return
+	}
+	defer s.dispatching.Done()
 
 	// Read the request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Info("Error reading request body", zap.Error(err))
+		logger.Warn("Error reading request body", zap.Error(err))
+		span.RecordError(err)
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
-		webhooksHandled.With(prometheus.Labels{"status": "fail"}).Inc()
+		audit.reject(http.StatusBadRequest, "error reading request body")
 		return
 	}
 
-	if s.config.GithubSecret != "" {
+	audit.Signature = signatureNotRequired
+	if signed {
 		// Get the GitHub signature from the request headers
 		githubSignature := r.Header.Get("X-Hub-Signature-256")
 
-		// Verify the signature
-		if !verifySignature(githubSignature, body, []byte(s.config.GithubSecret)) {
-			s.logger.Info("Signature verification failed")
+		// Verify the signature, trying secrets in order
+		secretName, ok := verifySignatures(githubSignature, body, secrets)
+		if !ok && len(secrets) == 0 {
+			logger.Warn("All webhook secrets expired, rejecting webhook")
+		}
+		if !ok {
+			logger.Warn("Signature verification failed")
 			http.Error(w, "Signature verification failed", http.StatusUnauthorized)
-			webhooksHandled.With(prometheus.Labels{"status": "fail"}).Inc()
+			audit.Signature = signatureInvalid
+			audit.reject(http.StatusUnauthorized, "signature verification failed")
 			return
 		}
+		signaturesValidated.With(prometheus.Labels{"secret": secretName}).Inc()
+		audit.Signature = signatureValid
+		audit.SignatureSecret = secretName
 	}
 
 	var requestPayload ExpectedPayload
 
 	err = json.Unmarshal(body, &requestPayload)
 	if err != nil {
-		s.logger.Info("Error unmarshalling request body", zap.Error(err))
+		logger.Warn("Error unmarshalling request body", zap.Error(err))
+		span.RecordError(err)
 		w.WriteHeader(http.StatusBadRequest)
-		webhooksHandled.With(prometheus.Labels{"status": "fail"}).Inc()
+		audit.reject(http.StatusBadRequest, "invalid payload")
 		return
 	}
 
+	audit.Status = http.StatusOK
 	switch {
 	case s.validate.Struct(requestPayload.ContainerPushPayload) == nil:
-		s.HandleContainerPushPayload(requestPayload.ContainerPushPayload)
+		event, results := s.HandleContainerPushPayload(ctx, requestPayload.ContainerPushPayload, namespaces)
+		audit.Outcome = auditDispatched
+		audit.Event = &event
+		audit.Results = results
 	case s.validate.Struct(requestPayload.PingEventPayload) == nil:
+		audit.Outcome = auditIgnored
+		audit.Reason = "ping"
 	default:
+		audit.Outcome = auditIgnored
+		audit.Reason = "not a container push"
+	}
+}
+
+// writeAudit records the webhook request in the audit log, if enabled
+func (s *Handlers) writeAudit(audit *AuditRecord) {
+	if err := s.audit.Write(audit); err != nil {
+		s.logger.Error("Failed to write audit log", zap.Error(err), zap.String("deliveryId", audit.DeliveryId))
 	}
-	webhooksHandled.With(prometheus.Labels{"status": "success"}).Inc()
 }
 
 func (s *Handlers) RegisterClient(subscr *Subscriber) {
@@ -226,15 +1000,35 @@ func (s *Handlers) RegisterClient(subscr *Subscriber) {
 
 	s.subscribers[subscr] = true
 	clientsConnected.Inc()
+	if !subscr.expiresAt.IsZero() {
+		subscr.expiry = time.AfterFunc(time.Until(subscr.expiresAt), func() {
+			s.logger.Info("Disconnecting subscriber with expired credentials", zap.String("clientId", subscr.id), zap.String("clientName", subscr.name))
+			subscr.revoke()
+		})
+	}
 }
 
 func (s *Handlers) UnregisterClient(subscr *Subscriber) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	close(subscr.send)
+	close(subscr.done)
+	if subscr.expiry != nil {
+		subscr.expiry.Stop()
+	}
 	delete(s.subscribers, subscr)
 	clientsConnected.Dec()
+	subscriberQueueDepth.Delete(prometheus.Labels{"client_id": subscr.id, "client": subscr.name})
+}
+
+// verifySignatures returns the name of the first secret the signature is valid for
+func verifySignatures(signatureHeader string, payload []byte, secrets []WebhookSecret) (string, bool) {
+	for _, secret := range secrets {
+		if verifySignature(signatureHeader, payload, []byte(secret.Secret)) {
+			return secret.Name, true
+		}
+	}
+	return "", false
 }
 
 func verifySignature(signatureHeader string, payload []byte, secret []byte) bool {
@@ -258,3 +1052,19 @@ func verifySignature(signatureHeader string, payload []byte, secret []byte) bool
 	// Compare the calculated HMAC with the provided HMAC
 	return hmac.Equal(providedMAC, expectedMAC)
 }
+
+// waitContext waits for the wait group or until the context is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
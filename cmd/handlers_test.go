@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	sourceController "github.com/fluxcd/source-controller/api/v1beta2"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sharedBus delivers published events and reports to every replica synchronously, like Redis pub/sub
+type sharedBus struct {
+	m        sync.Mutex
+	replicas []*Handlers
+}
+
+func (b *sharedBus) join(handlers *Handlers) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.replicas = append(b.replicas, handlers)
+	handlers.bus = b
+}
+
+func (b *sharedBus) members() []*Handlers {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return append([]*Handlers{}, b.replicas...)
+}
+
+func (b *sharedBus) Publish(_ context.Context, event SubscribeEventPayload) error {
+	for _, replica := range b.members() {
+		replica.receive(event)
+	}
+	return nil
+}
+
+func (b *sharedBus) PublishReport(_ context.Context, report ReportMessage) error {
+	for _, replica := range b.members() {
+		replica.receiveReport(report)
+	}
+	return nil
+}
+
+func (b *sharedBus) Run(context.Context) {}
+
+func (b *sharedBus) Ping(context.Context) error {
+	return nil
+}
+
+// fakeSourceAPI serves a single OCIRepository and counts reconcile request patches of it
+func fakeSourceAPI(t *testing.T, repository sourceController.OCIRepository) (*rest.RESTClient, *atomic.Int32) {
+	patches := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			list := sourceController.OCIRepositoryList{
+				TypeMeta: metav1.TypeMeta{Kind: "OCIRepositoryList", APIVersion: sourceController.GroupVersion.String()},
+				Items:    []sourceController.OCIRepository{repository},
+			}
+			_ = json.NewEncoder(w).Encode(list)
+		case http.MethodPatch:
+			patches.Add(1)
+			_ = json.NewEncoder(w).Encode(repository)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	scheme := runtime.NewScheme()
+	if err := sourceController.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host: server.URL,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &sourceController.GroupVersion,
+			NegotiatedSerializer: serializer.NewCodecFactory(scheme),
+		},
+		APIPath: "/apis",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, patches
+}
+
+func TestDispatchReconcilesOnceAcrossReplicas(t *testing.T) {
+	repository := sourceController.OCIRepository{
+		TypeMeta:   metav1.TypeMeta{Kind: "OCIRepository", APIVersion: sourceController.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: sourceController.OCIRepositorySpec{
+			URL:       "oci://ghcr.io/org/app",
+			Reference: &sourceController.OCIRepositoryRef{Tag: "latest"},
+		},
+	}
+	event := SubscribeEventPayload{Id: "event", OciUrl: repository.Spec.URL, Tag: "latest"}
+
+	tests := []struct {
+		name           string
+		leaderElection bool
+		// index of the replica receiving the webhook, replica 0 leads with leader election
+		receiver int
+		// reconciliations expected on each replica
+		want [2]int32
+	}{
+		{name: "follower receives webhook", leaderElection: true, receiver: 1, want: [2]int32{1, 0}},
+		{name: "leader receives webhook", leaderElection: true, receiver: 0, want: [2]int32{1, 0}},
+		{name: "without leader election", receiver: 1, want: [2]int32{0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus := &sharedBus{}
+			var replicas [2]*Handlers
+			var patches [2]*atomic.Int32
+			for i := range replicas {
+				var leader *LeaderElector
+				if test.leaderElection {
+					leader = &LeaderElector{logger: zap.NewNop()}
+					leader.setLeading(i == 0)
+				}
+				config := Config{InstanceId: []string{"replica-0", "replica-1"}[i]}
+				var client *rest.RESTClient
+				client, patches[i] = fakeSourceAPI(t, repository)
+				reconciler := NewReconciler(config, client, nil, nil, nil, leader, zap.NewNop())
+				replicas[i] = NewHandlers(config, reconciler, nil, nil, zap.NewNop())
+				bus.join(replicas[i])
+			}
+
+			replicas[test.receiver].dispatch(event, true)
+
+			for i := range replicas {
+				if got := patches[i].Load(); got != test.want[i] {
+					t.Errorf("replica %d reconciled %d times, want %d", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriberAccepts(t *testing.T) {
+	event := SubscribeEventPayload{OciUrl: "oci://ghcr.io/codex-team/app", Tag: "v1"}
+
+	tests := []struct {
+		name       string
+		registries []string
+		namespaces []string
+		filters    SubscriptionFilters
+		event      SubscribeEventPayload
+		want       bool
+		// namespaces the accepted event is restricted to
+		wantNamespaces []string
+	}{
+		{name: "no restrictions", event: event, want: true},
+		{name: "registry prefix", registries: []string{"ghcr.io/codex-team"}, event: event, want: true},
+		{name: "registry prefix with slash", registries: []string{"ghcr.io/codex-team/"}, event: event, want: true},
+		{name: "exact image", registries: []string{"ghcr.io/codex-team/app"}, event: event, want: true},
+		{name: "other registry", registries: []string{"docker.io/codex-team"}, event: event},
+		{name: "registry prefix not on a path boundary", registries: []string{"ghcr.io/codex"}, event: event},
+		{name: "any of the registries", registries: []string{"docker.io", "ghcr.io"}, event: event, want: true},
+		{name: "filtered out by tag", filters: SubscriptionFilters{Tags: []string{"v2*"}}, event: event},
+		{
+			name:           "restricted to the subscriber namespaces",
+			namespaces:     []string{"team"},
+			event:          event,
+			want:           true,
+			wantNamespaces: []string{"team"},
+		},
+		{
+			name:           "intersection with the event namespaces",
+			namespaces:     []string{"team", "staging"},
+			event:          SubscribeEventPayload{OciUrl: event.OciUrl, Tag: event.Tag, Namespaces: []string{"staging", "other"}},
+			want:           true,
+			wantNamespaces: []string{"staging"},
+		},
+		{
+			name:       "no common namespaces",
+			namespaces: []string{"team"},
+			event:      SubscribeEventPayload{OciUrl: event.OciUrl, Tag: event.Tag, Namespaces: []string{"other"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subscr := &Subscriber{registries: test.registries, namespaces: test.namespaces, filters: test.filters}
+			got, ok := subscr.accepts(test.event)
+			if ok != test.want {
+				t.Fatalf("accepted %t, want %t", ok, test.want)
+			}
+			if ok && !reflect.DeepEqual(got.Namespaces, test.wantNamespaces) {
+				t.Errorf("namespaces %v, want %v", got.Namespaces, test.wantNamespaces)
+			}
+		})
+	}
+}
+
+// blockingBus holds published events until released
+type blockingBus struct {
+	EventBus
+	published chan struct{}
+	release   chan struct{}
+}
+
+func (b *blockingBus) Publish(ctx context.Context, event SubscribeEventPayload) error {
+	close(b.published)
+	<-b.release
+	return b.EventBus.Publish(ctx, event)
+}
+
+func TestShutdownDeliversInFlightWebhooks(t *testing.T) {
+	handlers := NewHandlers(Config{Mode: "server", InstanceId: "replica-0"}, nil, nil, nil, zap.NewNop())
+	bus := &blockingBus{EventBus: handlers.bus, published: make(chan struct{}), release: make(chan struct{})}
+	handlers.bus = bus
+	subscr := &Subscriber{id: "subscriber", send: make(chan SubscribeEventPayload, 1), done: make(chan struct{})}
+	handlers.RegisterClient(subscr)
+
+	payload := `{"action": "published", "registry_package": {"name": "app", "namespace": "org", "package_type": "CONTAINER",
+		"package_version": {"container_metadata": {"tag": {"name": "v1"}}}}}`
+	status := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		handlers.Webhook(w, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload)))
+		status <- w.Code
+	}()
+
+	// shut down while the webhook is publishing its event
+	<-bus.published
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- handlers.Shutdown(context.Background())
+	}()
+	for stopping := false; !stopping; {
+		handlers.m.Lock()
+		stopping = handlers.stopping
+		handlers.m.Unlock()
+	}
+	close(bus.release)
+
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("webhook responded with %d, want %d", got, http.StatusOK)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if got := len(subscr.send); got != 1 {
+		t.Errorf("delivered %d events, want 1", got)
+	}
+
+	// webhooks arriving after shutdown are rejected
+	w := httptest.NewRecorder()
+	handlers.Webhook(w, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("webhook after shutdown responded with %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestNotifiesOnceAcrossReplicas(t *testing.T) {
+	var m sync.Mutex
+	var summaries []EventSummary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary EventSummary
+		if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+			t.Error(err)
+		}
+		m.Lock()
+		summaries = append(summaries, summary)
+		m.Unlock()
+	}))
+	defer server.Close()
+
+	bus := &sharedBus{}
+	var replicas [2]*Handlers
+	var subscribers [2]*Subscriber
+	for i := range replicas {
+		config := Config{InstanceId: []string{"replica-0", "replica-1"}[i]}
+		config.Notifications.Window = time.Minute
+		config.Notifications.Notifiers = []NotifierConfig{{Name: "audit", Type: notifierGeneric, URL: server.URL}}
+		replicas[i] = NewHandlers(config, nil, nil, nil, zap.NewNop())
+		bus.join(replicas[i])
+		subscribers[i] = &Subscriber{
+			id:        []string{"subscriber-0", "subscriber-1"}[i],
+			name:      []string{"staging", "production"}[i],
+			transport: transportGRPC,
+			send:      make(chan SubscribeEventPayload, 1),
+			done:      make(chan struct{}),
+		}
+		replicas[i].RegisterClient(subscribers[i])
+	}
+
+	// replica 1 receives the webhook, the subscriber of replica 0 reports first
+	replicas[1].dispatch(SubscribeEventPayload{Id: "event", OciUrl: "oci://ghcr.io/org/app", Tag: "v1"}, true)
+	for i := range replicas {
+		replicas[i].recordResults(subscribers[i], ResultMessage{EventId: "event", Results: []ReconcileResult{{Kind: kindOCIRepository, Name: "app"}}})
+	}
+	for i := range replicas {
+		if err := replicas[i].notifier.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(summaries) != 1 {
+		t.Fatalf("sent %d summaries, want 1", len(summaries))
+	}
+	if clusters := summaries[0].Clusters; len(clusters) != 2 || !clusters[0].Reported || !clusters[1].Reported {
+		t.Errorf("summarized clusters %+v, want both clusters reported", clusters)
+	}
+}
+
+// signature returns the X-Hub-Signature-256 header GitHub sends for the payload signed with the secret
+func signature(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestActiveGithubSecrets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	valid := now.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		primary string
+		secrets []WebhookSecret
+		want    []string
+	}{
+		{name: "no secrets"},
+		{name: "primary secret", primary: "s3cr3t", want: []string{primaryGithubSecretName}},
+		{
+			name:    "primary first",
+			primary: "s3cr3t",
+			secrets: []WebhookSecret{{Name: "next", Secret: "n3xt"}},
+			want:    []string{primaryGithubSecretName, "next"},
+		},
+		{
+			name:    "rotation window",
+			secrets: []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &valid}, {Name: "new", Secret: "n3w"}},
+			want:    []string{"old", "new"},
+		},
+		{
+			name:    "expired secret",
+			secrets: []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &expired}, {Name: "new", Secret: "n3w"}},
+			want:    []string{"new"},
+		},
+		{
+			name:    "expiring now",
+			secrets: []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &now}},
+			want:    []string{"old"},
+		},
+		{
+			name:    "all expired",
+			secrets: []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &expired}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{GithubSecret: test.primary, GithubSecrets: test.secrets}
+			var got []string
+			for _, secret := range config.ActiveGithubSecrets(now) {
+				got = append(got, secret.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("active secrets %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	payload := []byte(`{"action": "published"}`)
+	secrets := []WebhookSecret{{Name: "old", Secret: "0ld"}, {Name: "new", Secret: "n3w"}}
+
+	tests := []struct {
+		name      string
+		signature string
+		secrets   []WebhookSecret
+		want      string
+		wantOk    bool
+	}{
+		{name: "first secret", signature: signature(payload, "0ld"), secrets: secrets, want: "old", wantOk: true},
+		{name: "second secret", signature: signature(payload, "n3w"), secrets: secrets, want: "new", wantOk: true},
+		{name: "unknown secret", signature: signature(payload, "other"), secrets: secrets},
+		{name: "no secrets", signature: signature(payload, "0ld")},
+		{name: "other payload", signature: signature([]byte(`{}`), "0ld"), secrets: secrets},
+		{name: "missing signature", secrets: secrets},
+		{name: "SHA-1 signature", signature: "sha1=" + strings.TrimPrefix(signature(payload, "0ld"), "sha256="), secrets: secrets},
+		{name: "invalid hex", signature: "sha256=not-hex", secrets: secrets},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := verifySignatures(test.signature, payload, test.secrets)
+			if got != test.want || ok != test.wantOk {
+				t.Errorf("verified with %q (%t), want %q (%t)", got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestWebhookSignatures(t *testing.T) {
+	payload := []byte(`{"action": "published", "registry_package": {"name": "app", "namespace": "org", "package_type": "CONTAINER",
+		"package_version": {"container_metadata": {"tag": {"name": "v1"}}}}}`)
+	expired := time.Now().Add(-time.Hour)
+	valid := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		secrets   []WebhookSecret
+		signature string
+		want      int
+	}{
+		{name: "unsigned without secrets", want: http.StatusOK},
+		{
+			name:      "old secret in the rotation window",
+			secrets:   []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &valid}, {Name: "new", Secret: "n3w"}},
+			signature: signature(payload, "0ld"),
+			want:      http.StatusOK,
+		},
+		{
+			name:      "new secret",
+			secrets:   []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &valid}, {Name: "new", Secret: "n3w"}},
+			signature: signature(payload, "n3w"),
+			want:      http.StatusOK,
+		},
+		{
+			name:      "expired secret",
+			secrets:   []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &expired}, {Name: "new", Secret: "n3w"}},
+			signature: signature(payload, "0ld"),
+			want:      http.StatusUnauthorized,
+		},
+		{
+			name:      "all secrets expired",
+			secrets:   []WebhookSecret{{Name: "old", Secret: "0ld", ExpiresAt: &expired}},
+			signature: signature(payload, "0ld"),
+			want:      http.StatusUnauthorized,
+		},
+		{
+			name:    "unsigned with secrets",
+			secrets: []WebhookSecret{{Name: "new", Secret: "n3w"}},
+			want:    http.StatusUnauthorized,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handlers := NewHandlers(Config{Mode: "server", InstanceId: "replica-0", GithubSecrets: test.secrets}, nil, nil, nil, zap.NewNop())
+			r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(payload)))
+			if test.signature != "" {
+				r.Header.Set("X-Hub-Signature-256", test.signature)
+			}
+			w := httptest.NewRecorder()
+			handlers.Webhook(w, r)
+			if w.Code != test.want {
+				t.Errorf("webhook responded with %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateSubscriber(t *testing.T) {
+	config := Config{
+		SubscribeSecret: "shared-secret",
+		SubscribeTokens: []SubscribeToken{
+			{Name: "cluster-eu", Token: "token-for-eu"},
+			{Name: "cluster-us", Token: "token-for-us", Revoked: true},
+		},
+	}
+	config.JWT.HMACKey = "signing-key"
+	sign := func(claims SubscriberClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.JWT.HMACKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := SubscriberClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		Cluster:          "staging",
+		Registries:       []string{"ghcr.io/org"},
+	}
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name   string
+		config Config
+		token  string
+		want   subscriberIdentity
+		// wantErr is the error authentication fails with, nil if it succeeds
+		wantErr error
+	}{
+		{name: "no credentials configured", want: subscriberIdentity{Name: anonymousClientName}},
+		{name: "shared secret", config: config, token: "shared-secret", want: subscriberIdentity{Name: sharedSecretClientName}},
+		{name: "per-client token", config: config, token: "token-for-eu", want: subscriberIdentity{Name: "cluster-eu"}},
+		{name: "revoked token", config: config, token: "token-for-us", wantErr: errInvalidCredentials},
+		{name: "missing token", config: config, wantErr: errMissingCredentials},
+		{name: "prefix of a token", config: config, token: "token-for", wantErr: errInvalidCredentials},
+		{name: "token with a suffix", config: config, token: "token-for-eu2", wantErr: errInvalidCredentials},
+		{name: "token of another case", config: config, token: "TOKEN-FOR-EU", wantErr: errInvalidCredentials},
+		{
+			name:   "JWT",
+			config: config,
+			token:  sign(valid),
+			want:   subscriberIdentity{Name: "staging", Registries: []string{"ghcr.io/org"}, ExpiresAt: valid.ExpiresAt.Time},
+		},
+		{name: "expired JWT", config: config, token: sign(expired), wantErr: errInvalidCredentials},
+		{name: "JWT without a verifier", config: Config{SubscribeSecret: "shared-secret"}, token: sign(valid), wantErr: errInvalidCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			active := newActiveConfig(test.config)
+			got, err := authenticateSubscriber(active.Config, active.jwtVerifier, test.token)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("identity %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSubscriberCredentials(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		query         string
+		want          string
+		wantFromQuery bool
+	}{
+		{name: "bearer token", header: "Bearer token", want: "token"},
+		{name: "surrounding spaces", header: "Bearer  token ", want: "token"},
+		{name: "other scheme", header: "Basic dXNlcjpwYXNz"},
+		{name: "header takes precedence", header: "Bearer token", query: "secret", want: "token"},
+		{name: "deprecated query parameter", query: "secret", want: "secret", wantFromQuery: true},
+		{name: "no credentials", wantFromQuery: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/subscribe?authSecret="+test.query, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			got, fromQuery := subscriberCredentials(r)
+			if got != test.want || fromQuery != test.wantFromQuery {
+				t.Errorf("credentials %q (from query %t), want %q (from query %t)", got, fromQuery, test.want, test.wantFromQuery)
+			}
+		})
+	}
+}
+
+func TestReloadRevokesSubscribers(t *testing.T) {
+	tokens := []SubscribeToken{{Name: "cluster-eu", Token: "token-for-eu"}, {Name: "cluster-us", Token: "token-for-us"}}
+
+	tests := []struct {
+		name   string
+		config Config
+		token  string
+		reload Config
+		want   bool
+	}{
+		{
+			name:   "token revoked",
+			config: Config{SubscribeTokens: tokens},
+			token:  "token-for-eu",
+			reload: Config{SubscribeTokens: []SubscribeToken{{Name: "cluster-eu", Token: "token-for-eu", Revoked: true}, tokens[1]}},
+			want:   true,
+		},
+		{
+			name:   "other token revoked",
+			config: Config{SubscribeTokens: tokens},
+			token:  "token-for-eu",
+			reload: Config{SubscribeTokens: []SubscribeToken{tokens[0], {Name: "cluster-us", Token: "token-for-us", Revoked: true}}},
+		},
+		{
+			name:   "shared secret rotated",
+			config: Config{SubscribeSecret: "old-secret"},
+			token:  "old-secret",
+			reload: Config{SubscribeSecret: "new-secret"},
+			want:   true,
+		},
+		{
+			name:   "authentication enabled",
+			reload: Config{SubscribeSecret: "new-secret"},
+			want:   true,
+		},
+		{
+			name:   "unchanged",
+			config: Config{SubscribeSecret: "secret"},
+			token:  "secret",
+			reload: Config{SubscribeSecret: "secret"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handlers := NewHandlers(test.config, nil, nil, nil, zap.NewNop())
+			subscr, err := handlers.newSubscriber(test.token, false, nil, transportWebsocket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handlers.RegisterClient(subscr)
+			defer handlers.UnregisterClient(subscr)
+
+			handlers.Reload(test.reload)
+			if got := subscr.isRevoked(); got != test.want {
+				t.Errorf("revoked %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpiredSubscribersAreDisconnected(t *testing.T) {
+	config := Config{}
+	config.JWT.HMACKey = "signing-key"
+	handlers := NewHandlers(config, nil, nil, nil, zap.NewNop())
+	server := httptest.NewServer(http.HandlerFunc(handlers.SubscribeSSE))
+	defer server.Close()
+
+	// expirations have a precision of seconds
+	claims := SubscriberClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(2 * time.Second))}, Cluster: "staging"}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.JWT.HMACKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscribing responded with %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().Before(claims.ExpiresAt.Time) {
+			t.Error("stream closed before the token expired")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream of the expired subscriber wasn't closed")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Time allowed for all readiness checks of a single probe
+const readinessTimeout = 5 * time.Second
+
+// Health serves liveness and readiness probes, readiness runs the registered checks
+type Health struct {
+	leader *LeaderElector
+	logger *zap.Logger
+
+	m      sync.Mutex
+	checks []healthCheck
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// HealthStatus is the JSON output of the probes
+type HealthStatus struct {
+	Status string `json:"status"`
+
+	// Leader is whether this replica reconciles sources, always true without leader election
+	Leader bool `json:"leader"`
+
+	Checks map[string]CheckStatus `json:"checks,omitempty"`
+}
+
+// CheckStatus is the result of a single readiness check
+type CheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func NewHealth(leader *LeaderElector, logger *zap.Logger) *Health {
+	return &Health{leader: leader, logger: logger}
+}
+
+// AddCheck registers a readiness check, the replica isn't ready while it fails
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// Handle registers the probe endpoints on the mux
+func (h *Health) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.Liveness)
+	mux.HandleFunc("/readyz", h.Readiness)
+}
+
+// Liveness reports that the process is serving requests, it doesn't depend on external systems
+func (h *Health) Liveness(w http.ResponseWriter, r *http.Request) {
+	h.write(w, http.StatusOK, HealthStatus{Status: "ok", Leader: h.leader.IsLeader()})
+}
+
+// Readiness runs all checks and reports their results. Followers of the leader election are ready too,
+// they stay connected to take over reconciliation immediately.
+func (h *Health) Readiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	h.m.Lock()
+	checks := append([]healthCheck{}, h.checks...)
+	h.m.Unlock()
+
+	status := HealthStatus{Status: "ok", Leader: h.leader.IsLeader(), Checks: make(map[string]CheckStatus)}
+	code := http.StatusOK
+	for _, check := range checks {
+		if err := check.check(ctx); err != nil {
+			status.Status = "fail"
+			status.Checks[check.name] = CheckStatus{Status: "fail", Error: err.Error()}
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		status.Checks[check.name] = CheckStatus{Status: "ok"}
+	}
+
+	h.write(w, code, status)
+}
+
+func (h *Health) write(w http.ResponseWriter, code int, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Error("Error encoding health status", zap.Error(err))
+	}
+}
+
+// kubernetesCheck checks that the Kubernetes API is reachable
+func kubernetesCheck(client kubernetes.Interface) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := client.Discovery().RESTClient().Get().AbsPath("/readyz").DoRaw(ctx)
+		return err
+	}
+}
+
+// crdCheck checks that the API serves every resource the reconciler uses with the given config
+func crdCheck(client kubernetes.Interface, config Config) func(ctx context.Context) error {
+	resources := []schema.GroupVersionResource{ociRepositoriesResource}
+	if config.ImageAutomation.Enabled {
+		resources = append(resources, imageRepositoriesResource, imagePoliciesResource, imageUpdateAutomationsResource)
+	}
+	if config.Policies.Enabled {
+		resources = append(resources, autoReconcilePoliciesResource)
+	}
+
+	return func(ctx context.Context) error {
+		for _, resource := range resources {
+			list, err := client.Discovery().ServerResourcesForGroupVersion(resource.GroupVersion().String())
+			if err != nil {
+				return fmt.Errorf("%s: %w", resource.GroupVersion(), err)
+			}
+			found := false
+			for _, apiResource := range list.APIResources {
+				if apiResource.Name == resource.Resource {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("resource %s is not served", resource)
+			}
+		}
+		return nil
+	}
+}
+
+// serveProbes serves the probe endpoints on host and port of the config in client mode, which has no other HTTP server there
+func serveProbes(ctx context.Context, config Config, health *Health, logger *zap.Logger) {
+	addr := fmt.Sprintf("%s:%s", config.Host, config.Port)
+	mux := http.NewServeMux()
+	health.Handle(mux)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		logger.Info("Starting probe server", zap.String("addr", addr))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("Failed to start probe server", zap.Error(err))
+		}
+	}()
+
+	<-ctx.Done()
+	if err := server.Shutdown(context.Background()); err != nil {
+		logger.Warn("Failed to shutdown probe server", zap.Error(err))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
+)
+
+var (
+	imageRepositoriesResource = schema.GroupVersionResource{
+		Group:    "image.toolkit.fluxcd.io",
+		Version:  "v1beta2",
+		Resource: "imagerepositories",
+	}
+
+	imagePoliciesResource = schema.GroupVersionResource{
+		Group:    "image.toolkit.fluxcd.io",
+		Version:  "v1beta2",
+		Resource: "imagepolicies",
+	}
+
+	imageUpdateAutomationsResource = schema.GroupVersionResource{
+		Group:    "image.toolkit.fluxcd.io",
+		Version:  "v1beta1",
+		Resource: "imageupdateautomations",
+	}
+)
+
+// ReconcileImageRepositories requests reconciliation of every ImageRepository scanning the pushed image,
+// so image-reflector-controller picks up the new tag without waiting for its scan interval.
+// If enabled in config or by policies, ImageUpdateAutomations of namespaces with policies for those repositories are reconciled too.
+func (r *Reconciler) ReconcileImageRepositories(event SubscribeEventPayload) []ReconcileResult {
+	image := strings.TrimPrefix(event.OciUrl, "oci://")
+
+	imageRepositories, err := r.dynamicClient.Resource(imageRepositoriesResource).Namespace("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		r.logger.Error("Failed to get ImageRepositories", zap.Error(err))
+		return nil
+	}
+
+	var results []ReconcileResult
+	var reconciled []unstructured.Unstructured
+	for _, imageRepository := range imageRepositories.Items {
+		spec, _, _ := unstructured.NestedString(imageRepository.Object, "spec", "image")
+		if spec != image {
+			continue
+		}
+
+		allowed, policies := r.permits(kindImageRepository, imageRepository.GetNamespace(), imageRepository.GetLabels(), event, r.config.ImageAutomation.Enabled)
+		if !allowed {
+			continue
+		}
+
+		r.logger.Info("Reconciling ImageRepository", zap.String("name", imageRepository.GetName()), zap.String("namespace", imageRepository.GetNamespace()))
+		requestedAt := reconcileRequestedAt()
+		err := r.annotateResource(imageRepositoriesResource, imageRepository.GetNamespace(), imageRepository.GetName(), requestedAt)
+		results = append(results, newReconcileResult(kindImageRepository, imageRepository.GetNamespace(), imageRepository.GetName(), err))
+		recordReconciliation(kindImageRepository, imageRepository.GetNamespace(), imageRepository.GetName(), event, err)
+		if err != nil {
+			r.logger.Error("Failed to annotate ImageRepository", zap.Error(err))
+			continue
+		}
+		r.ready.Track(imageRepositoriesResource, kindImageRepository, imageRepository.GetNamespace(), imageRepository.GetName(), requestedAt, event)
+		r.markTriggered(policies)
+		reconciled = append(reconciled, imageRepository)
+	}
+
+	if len(reconciled) > 0 {
+		results = append(results, r.reconcileImageUpdateAutomations(reconciled, event)...)
+	}
+	return results
+}
+
+// reconcileImageUpdateAutomations requests reconciliation of ImageUpdateAutomations living in the namespaces
+// of ImagePolicies that reference one of the given ImageRepositories.
+func (r *Reconciler) reconcileImageUpdateAutomations(imageRepositories []unstructured.Unstructured, event SubscribeEventPayload) []ReconcileResult {
+	if !r.config.ImageAutomation.ReconcileUpdateAutomations && r.policies == nil {
+		return nil
+	}
+
+	policies, err := r.dynamicClient.Resource(imagePoliciesResource).Namespace("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		r.logger.Error("Failed to get ImagePolicies", zap.Error(err))
+		return nil
+	}
+
+	namespaces := make(map[string]bool)
+	for _, policy := range policies.Items {
+		refName, _, _ := unstructured.NestedString(policy.Object, "spec", "imageRepositoryRef", "name")
+		refNamespace, _, _ := unstructured.NestedString(policy.Object, "spec", "imageRepositoryRef", "namespace")
+		if refNamespace == "" {
+			refNamespace = policy.GetNamespace()
+		}
+
+		for _, imageRepository := range imageRepositories {
+			if imageRepository.GetName() == refName && imageRepository.GetNamespace() == refNamespace {
+				namespaces[policy.GetNamespace()] = true
+			}
+		}
+	}
+
+	var results []ReconcileResult
+	for namespace := range namespaces {
+		automations, err := r.dynamicClient.Resource(imageUpdateAutomationsResource).Namespace(namespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			r.logger.Error("Failed to get ImageUpdateAutomations", zap.Error(err), zap.String("namespace", namespace))
+			continue
+		}
+
+		for _, automation := range automations.Items {
+			allowed, policies := r.permits(kindImageUpdateAutomation, automation.GetNamespace(), automation.GetLabels(), event, r.config.ImageAutomation.ReconcileUpdateAutomations)
+			if !allowed {
+				continue
+			}
+
+			r.logger.Info("Reconciling ImageUpdateAutomation", zap.String("name", automation.GetName()), zap.String("namespace", automation.GetNamespace()))
+			requestedAt := reconcileRequestedAt()
+			err := r.annotateResource(imageUpdateAutomationsResource, automation.GetNamespace(), automation.GetName(), requestedAt)
+			results = append(results, newReconcileResult(kindImageUpdateAutomation, automation.GetNamespace(), automation.GetName(), err))
+			recordReconciliation(kindImageUpdateAutomation, automation.GetNamespace(), automation.GetName(), event, err)
+			if err != nil {
+				r.logger.Error("Failed to annotate ImageUpdateAutomation", zap.Error(err))
+				continue
+			}
+			r.ready.Track(imageUpdateAutomationsResource, kindImageUpdateAutomation, automation.GetNamespace(), automation.GetName(), requestedAt, event)
+			r.markTriggered(policies)
+		}
+	}
+	return results
+}
+
+func (r *Reconciler) annotateResource(resource schema.GroupVersionResource, namespace string, name string, requestedAt string) error {
+	_, err := r.dynamicClient.
+		Resource(resource).
+		Namespace(namespace).
+		Patch(context.Background(), name, types.MergePatchType, reconcileRequestPatch(requestedAt), metav1.PatchOptions{})
+	return err
+}
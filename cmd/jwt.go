@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubscriberClaims are claims of a JWT presented by a client, limiting what the cluster may receive
+type SubscriberClaims struct {
+	jwt.RegisteredClaims
+
+	// Cluster is the name of the client's cluster
+	Cluster string `json:"cluster"`
+
+	// Registries are prefixes of image references (e.g. "ghcr.io/codex-team") the cluster may receive events for
+	Registries []string `json:"registries,omitempty"`
+
+	// Namespaces are namespaces the cluster may reconcile sources in
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// jwtVerifier verifies subscriber JWTs signed with a shared HS256 key or with keys from a local JWKS file
+type jwtVerifier struct {
+	hmacKey  []byte
+	jwksFile string
+	parser   *jwt.Parser
+
+	m        sync.Mutex
+	keys     map[string]interface{}
+	jwksTime time.Time
+}
+
+func newJWTVerifier(config Config) *jwtVerifier {
+	var methods []string
+	if config.JWT.HMACKey != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if config.JWT.JWKSFile != "" {
+		methods = append(methods, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg())
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if config.JWT.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.JWT.Issuer))
+	}
+	if config.JWT.Audience != "" {
+		options = append(options, jwt.WithAudience(config.JWT.Audience))
+	}
+
+	return &jwtVerifier{
+		hmacKey:  []byte(config.JWT.HMACKey),
+		jwksFile: config.JWT.JWKSFile,
+		parser:   jwt.NewParser(options...),
+	}
+}
+
+// Verify parses the token and validates its signature and registered claims
+func (v *jwtVerifier) Verify(token string) (*SubscriberClaims, error) {
+	claims := &SubscriberClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, v.key)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Cluster == "" {
+		return nil, errors.New("token has no cluster claim")
+	}
+	return claims, nil
+}
+
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		return v.hmacKey, nil
+	}
+
+	keys, err := v.jwks()
+	if err != nil {
+		return nil, err
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// jwks returns public keys from the JWKS file by key ID, reloading them when the file changes
+func (v *jwtVerifier) jwks() (map[string]interface{}, error) {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	info, err := os.Stat(v.jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	if v.keys != nil && info.ModTime().Equal(v.jwksTime) {
+		return v.keys, nil
+	}
+
+	data, err := os.ReadFile(v.jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+
+	v.keys = keys
+	v.jwksTime = info.ModTime()
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes RSA and P-256 EC public keys of a JSON Web Key Set
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, key := range set.Keys {
+		switch key.Kty {
+		case "RSA":
+			n, err := decodeBigInt(key.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key.Kid, err)
+			}
+			e, err := decodeBigInt(key.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key.Kid, err)
+			}
+			keys[key.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if key.Crv != "P-256" {
+				return nil, fmt.Errorf("key %q: unsupported curve %s", key.Kid, key.Crv)
+			}
+			x, err := decodeBigInt(key.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key.Kid, err)
+			}
+			y, err := decodeBigInt(key.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key.Kid, err)
+			}
+			keys[key.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		default:
+			return nil, fmt.Errorf("key %q: unsupported key type %s", key.Kid, key.Kty)
+		}
+	}
+	return keys, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// isJWT reports whether the token looks like a compact serialized JWT
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
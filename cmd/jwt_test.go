@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func encodeBigInt(value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaJWK := fmt.Sprintf(`{"kid": "rsa", "kty": "RSA", "n": %q, "e": %q}`,
+		encodeBigInt(rsaKey.N), encodeBigInt(big.NewInt(int64(rsaKey.E))))
+	ecJWK := fmt.Sprintf(`{"kid": "ec", "kty": "EC", "crv": "P-256", "x": %q, "y": %q}`,
+		encodeBigInt(ecKey.X), encodeBigInt(ecKey.Y))
+
+	tests := []struct {
+		name    string
+		jwks    string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "RSA and EC keys",
+			jwks: fmt.Sprintf(`{"keys": [%s, %s]}`, rsaJWK, ecJWK),
+			want: map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey},
+		},
+		{
+			name: "empty set",
+			jwks: `{"keys": []}`,
+			want: map[string]interface{}{},
+		},
+		{
+			name:    "unsupported curve",
+			jwks:    `{"keys": [{"kid": "ec", "kty": "EC", "crv": "P-384", "x": "AQ", "y": "AQ"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported key type",
+			jwks:    `{"keys": [{"kid": "okp", "kty": "OKP", "crv": "Ed25519", "x": "AQ"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid modulus",
+			jwks:    `{"keys": [{"kid": "rsa", "kty": "RSA", "n": "not base64!", "e": "AQAB"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			jwks:    `{"keys": `,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(test.jwks))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if len(keys) != len(test.want) {
+				t.Fatalf("parsed %d keys, want %d", len(keys), len(test.want))
+			}
+			for kid, want := range test.want {
+				key, ok := keys[kid].(interface{ Equal(crypto.PublicKey) bool })
+				if !ok || !key.Equal(want) {
+					t.Errorf("key %q is %v, want %v", kid, keys[kid], want)
+				}
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 )
@@ -37,6 +38,10 @@ func getConfig() (*rest.Config, error) {
 	config.NegotiatedSerializer = serializer.NewCodecFactory(schema)
 	//config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(scheme)}
 
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return &instrumentedTransport{next: rt}
+	}
+
 	return config, nil
 }
 
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Lease name used when the config doesn't specify one
+	defaultLeaseName = "flux-webhook-autoreconciler"
+
+	// File with the namespace of the pod's service account, the default namespace of the Lease
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// LeaderElector elects a single replica allowed to reconcile sources using a Lease.
+// Followers stay connected and take over as soon as the leader's Lease expires.
+type LeaderElector struct {
+	config  leaderelection.LeaderElectionConfig
+	leading atomic.Bool
+	logger  *zap.Logger
+}
+
+func NewLeaderElector(client kubernetes.Interface, config Config, logger *zap.Logger) (*LeaderElector, error) {
+	identity, err := os.Hostname()
+	if err != nil || identity == "" {
+		identity = config.InstanceId
+	}
+
+	namespace := config.LeaderElection.LeaseNamespace
+	if namespace == "" {
+		namespace = "default"
+		if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	name := config.LeaderElection.LeaseName
+	if name == "" {
+		name = defaultLeaseName
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, namespace, name, client.CoreV1(), client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return nil, err
+	}
+
+	elector := &LeaderElector{logger: logger.With(zap.String("lease", namespace+"/"+name), zap.String("identity", identity))}
+	elector.config = leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   config.LeaderElection.LeaseDuration,
+		RenewDeadline:   config.LeaderElection.RenewDeadline,
+		RetryPeriod:     config.LeaderElection.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				elector.setLeading(true)
+				elector.logger.Info("Started leading, reconciling sources")
+			},
+			OnStoppedLeading: func() {
+				elector.setLeading(false)
+				elector.logger.Info("Stopped leading, no longer reconciling sources")
+			},
+			OnNewLeader: func(leader string) {
+				elector.logger.Info("Observed leader", zap.String("leader", leader))
+			},
+		},
+	}
+	return elector, nil
+}
+
+// Run takes part in the election until the context is done, releasing the Lease when leading
+func (e *LeaderElector) Run(ctx context.Context) {
+	elector, err := leaderelection.NewLeaderElector(e.config)
+	if err != nil {
+		e.logger.Fatal("Failed to create leader elector", zap.Error(err))
+	}
+
+	// Run returns whenever leadership is lost, keep competing for it
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+}
+
+// IsLeader reports whether this replica may reconcile sources. Without leader election every replica may.
+func (e *LeaderElector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+	return e.leading.Load()
+}
+
+func (e *LeaderElector) setLeading(leading bool) {
+	e.leading.Store(leading)
+	if leading {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+}
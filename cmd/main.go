@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"go.uber.org/zap"
@@ -13,57 +14,247 @@ import (
 	"syscall"
 )
 
-func runServer(ctx context.Context, wg *sync.WaitGroup, config Config, logger *zap.Logger) {
+func runServer(ctx context.Context, wg *sync.WaitGroup, config Config, leader *LeaderElector, health *Health, adminMux *http.ServeMux, watcher *ConfigWatcher, logger *zap.Logger) {
 	defer wg.Done()
-	addr := fmt.Sprintf("%s:%s", config.Host, config.Port)
 
-	k8sClient, err := getRestClient()
+	var reconciler *Reconciler
+	if *config.Reconcile {
+		reconciler = newReconciler(ctx, config, leader, logger)
+	} else {
+		logger.Info("Local reconciliation is disabled, only forwarding events to subscribers")
+	}
+	handlers := newHandlers(ctx, config, reconciler, logger)
+	watcher.OnReload(handlers.Reload)
+
+	serve(ctx, config, handlers, health, adminMux, logger)
+}
+
+func runClient(ctx context.Context, wg *sync.WaitGroup, config Config, leader *LeaderElector, health *Health, watcher *ConfigWatcher, logger *zap.Logger) {
+	defer wg.Done()
+	reconciler := newReconciler(ctx, config, leader, logger)
+
+	client := newClient(config, reconciler.ReconcileSources, logger)
+	watcher.OnReload(client.Reload)
+	health.AddCheck("upstream", client.CheckConnected)
+	go serveProbes(ctx, config, health, logger)
+
+	client.Run(ctx)
+}
+
+// runRelay connects to the upstream server like a client and serves downstream subscribers like a server,
+// forwarding every received event and optionally reconciling local sources
+func runRelay(ctx context.Context, wg *sync.WaitGroup, config Config, leader *LeaderElector, health *Health, adminMux *http.ServeMux, watcher *ConfigWatcher, logger *zap.Logger) {
+	defer wg.Done()
+
+	var reconciler *Reconciler
+	if *config.Reconcile {
+		reconciler = newReconciler(ctx, config, leader, logger)
+	}
+	handlers := newHandlers(ctx, config, reconciler, logger)
+
+	// the relay stops serving when it gives up connecting upstream
+	serveCtx, stopServing := context.WithCancel(ctx)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(serveCtx, config, handlers, health, adminMux, logger)
+	}()
+
+	client := newClient(upstreamConfig(config), handlers.Dispatch, logger)
+	health.AddCheck("upstream", client.CheckConnected)
+	watcher.OnReload(func(config Config) {
+		handlers.Reload(config)
+		client.Reload(upstreamConfig(config))
+	})
+
+	client.Run(ctx)
+	stopServing()
+	<-served
+}
+
+// upstreamConfig returns the config of the relay's connection to the upstream server
+func upstreamConfig(config Config) Config {
+	if config.Relay.UpstreamSecret != "" {
+		config.SubscribeSecret = config.Relay.UpstreamSecret
+	}
+	return config
+}
+
+// newHandlers creates server handlers, starting the tenant secrets watcher if tenant webhooks are configured
+// and receiving events from the event bus
+func newHandlers(ctx context.Context, config Config, reconciler *Reconciler, logger *zap.Logger) *Handlers {
+	var tenants *TenantWebhooks
+	if len(config.Webhooks) > 0 {
+		k8sClient, err := getClient()
+		if err != nil {
+			logger.Fatal("Failed to get Kubernetes client", zap.Error(err))
+		}
+		tenants = NewTenantWebhooks(k8sClient, config.Webhooks, logger)
+		go tenants.Run(ctx)
+	}
+
+	audit, err := NewAuditLog(config)
 	if err != nil {
-		logger.Fatal("Failed to get Kubernetes client", zap.Error(err))
+		logger.Fatal("Failed to open audit log", zap.Error(err))
 	}
+
+	handlers := NewHandlers(config, reconciler, tenants, audit, logger)
+	go handlers.bus.Run(ctx)
+	return handlers
+}
+
+// serve runs the HTTP server with webhook, subscribe and probe endpoints until the context is done
+func serve(ctx context.Context, config Config, handlers *Handlers, health *Health, adminMux *http.ServeMux, logger *zap.Logger) {
+	addr := fmt.Sprintf("%s:%s", config.Host, config.Port)
+
+	health.AddCheck("eventBus", handlers.bus.Ping)
+
 	mux := http.NewServeMux()
-	reconciler := NewReconciler(k8sClient, logger)
-	handlers := NewHandlers(config, reconciler, logger)
+	health.Handle(mux)
 	mux.Handle("/webhook", WithLogging(http.HandlerFunc(handlers.Webhook), logger))
 	mux.Handle("/subscribe", WithLogging(http.HandlerFunc(handlers.Subscribe), logger))
-	server := &http.Server{Addr: addr, Handler: mux}
+	mux.Handle("/subscribe/sse", WithLogging(http.HandlerFunc(handlers.SubscribeSSE), logger))
+	mux.Handle("/subscribe/poll", WithLogging(http.HandlerFunc(handlers.SubscribePoll), logger))
+	adminMux.HandleFunc("/subscribers", handlers.Subscribers)
+	if handlers.tenants != nil {
+		for _, path := range handlers.tenants.Paths() {
+			mux.Handle(path, WithLogging(http.HandlerFunc(handlers.TenantWebhook), logger))
+		}
+	}
+	tlsConfig, err := serverTLSConfig(config, logger)
+	if err != nil {
+		logger.Fatal("Failed to load TLS config", zap.Error(err))
+	}
+	server := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConfig}
+
+	if config.GRPC.Enabled {
+		go serveGRPC(ctx, config, handlers, logger)
+	}
 
 	go func() {
-		logger.Info("Starting server", zap.String("addr", addr))
-		err := server.ListenAndServe()
-		if err != nil {
+		logger.Info("Starting server", zap.String("addr", addr), zap.Bool("tls", tlsConfig != nil))
+		var err error
+		if tlsConfig != nil {
+			// certificates are provided by the TLS config
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Fatal("Failed to start server", zap.Error(err))
 		}
 	}()
 
 	<-ctx.Done()
-	logger.Info("Shutting down server")
+	logger.Info("Shutting down server", zap.Duration("timeout", config.ShutdownTimeout))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
 
-	if err := server.Shutdown(context.Background()); err != nil {
-		logger.Fatal("Failed to shutdown server", zap.Error(err))
+	// the server stops accepting connections before it calls the handlers, which dispatch in-flight webhooks
+	// and then tell subscribers to go away. The server waits for in-flight webhooks, SSE and long-poll streams.
+	handlersDone := make(chan error, 1)
+	server.RegisterOnShutdown(func() {
+		handlersDone <- handlers.Shutdown(shutdownCtx)
+	})
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Timed out waiting for in-flight requests", zap.Error(err))
+	}
+	if err := <-handlersDone; err != nil {
+		logger.Warn("Timed out waiting for subscribers and reconciliations", zap.Error(err))
 	}
 }
 
-func runClient(ctx context.Context, wg *sync.WaitGroup, config Config, logger *zap.Logger) {
-	defer wg.Done()
+// newClient creates a client connecting to the configured server endpoint
+func newClient(config Config, handle func(event SubscribeEventPayload) []ReconcileResult, logger *zap.Logger) *Client {
+	u, err := url.Parse(config.ServerEndpoint)
+	if err != nil {
+		logger.Fatal("Failed to parse server endpoint", zap.Error(err))
+	}
+
+	tlsConfig, err := clientTLSConfig(config, logger)
+	if err != nil {
+		logger.Fatal("Failed to load TLS config", zap.Error(err))
+	}
+
+	return NewClient(u, config, tlsConfig, handle, logger)
+}
+
+// newReconciler creates Kubernetes clients and a reconciler using them, starting the policy watcher and
+// the ready tracker if they are enabled.
+// The reconciler only reconciles while the leader, if leader election is enabled.
+func newReconciler(ctx context.Context, config Config, leader *LeaderElector, logger *zap.Logger) *Reconciler {
 	k8sClient, err := getRestClient()
 	if err != nil {
 		logger.Fatal("Failed to get Kubernetes client", zap.Error(err))
 	}
-	reconciler := NewReconciler(k8sClient, logger)
-
-	u, err := url.Parse(config.ServerEndpoint)
+	dynamicClient, err := getDynamicClient()
 	if err != nil {
-		logger.Fatal("Failed to parse server endpoint", zap.Error(err))
+		logger.Fatal("Failed to get Kubernetes dynamic client", zap.Error(err))
+	}
+
+	var policies *PolicyStore
+	if config.Policies.Enabled {
+		policies = NewPolicyStore(k8sClient, dynamicClient, logger)
+		go policies.Run(ctx)
 	}
 
-	query := u.Query()
-	query.Set("authSecret", config.SubscribeSecret)
-	u.RawQuery = query.Encode()
+	var ready *ReadyTracker
+	if config.ReadyTracking.Enabled {
+		ready = NewReadyTracker(dynamicClient, config, logger)
+		go ready.Run(ctx)
+	}
 
-	client := NewClient(u, reconciler, logger)
+	return NewReconciler(config, k8sClient, dynamicClient, policies, ready, leader, logger)
+}
 
-	client.Run(ctx)
+// newConfigWatcher reports the hash of the loaded config and starts watching the config for changes if reload is enabled,
+// returning nil otherwise
+func newConfigWatcher(ctx context.Context, configPath string, flags ConfigFlags, config Config, level zap.AtomicLevel, logger *zap.Logger) *ConfigWatcher {
+	watcher := NewConfigWatcher(configPath, flags, config, level, logger)
+	if !*config.Reload.Enabled {
+		return nil
+	}
+	go watcher.Run(ctx)
+	return watcher
+}
+
+// newHealth creates probes checking the Kubernetes API and Flux CRDs when the config needs them
+func newHealth(config Config, leader *LeaderElector, logger *zap.Logger) *Health {
+	health := NewHealth(leader, logger)
+
+	reconciles := config.Mode == "client" || *config.Reconcile
+	if !reconciles && len(config.Webhooks) == 0 && !config.LeaderElection.Enabled {
+		return health
+	}
+
+	client, err := getClient()
+	if err != nil {
+		logger.Fatal("Failed to get Kubernetes client", zap.Error(err))
+	}
+	health.AddCheck("kubernetes", kubernetesCheck(client))
+	if reconciles {
+		health.AddCheck("crds", crdCheck(client, config))
+	}
+	return health
+}
+
+// newLeaderElector starts leader election if enabled, returning nil otherwise
+func newLeaderElector(ctx context.Context, config Config, logger *zap.Logger) *LeaderElector {
+	if !config.LeaderElection.Enabled {
+		return nil
+	}
+
+	client, err := getClient()
+	if err != nil {
+		logger.Fatal("Failed to get Kubernetes client", zap.Error(err))
+	}
+	leader, err := NewLeaderElector(client, config, logger)
+	if err != nil {
+		logger.Fatal("Failed to create leader elector", zap.Error(err))
+	}
+	go leader.Run(ctx)
+	return leader
 }
 
 func WithLogging(h http.Handler, logger *zap.Logger) http.Handler {
@@ -81,11 +272,12 @@ func main() {
 	var loggerMode string
 	flag.StringVar(&loggerMode, "log-mode", "prod", "Logger mode")
 
-	var logLevel string
-	flag.StringVar(&logLevel, "log-level", "info", "Log level")
-
 	var configPath string
-	flag.StringVar(&configPath, "config", "config.yaml", "Path to config file")
+	flag.StringVar(&configPath, "config", "", fmt.Sprintf("Path to config file, %s is used if it exists", defaultConfigPath))
+
+	// every config setting can be set with a flag, e.g. --log-level or --metrics.enabled
+	configFlags := ConfigFlags{}
+	configFlags.Register(flag.CommandLine)
 	flag.Parse()
 
 	var loggerConfig zap.Config
@@ -95,22 +287,30 @@ func main() {
 		loggerConfig = zap.NewProductionConfig()
 	}
 
-	level, err := zap.ParseAtomicLevel(logLevel)
-
-	if err != nil {
-		logger := zap.Must(zap.NewProduction())
-		logger.Fatal("Failed to parse log level", zap.Error(err))
-	}
-
+	// the level is set from the config once it's loaded
+	level := zap.NewAtomicLevel()
 	loggerConfig.Level = level
 	logger := zap.Must(loggerConfig.Build())
 	defer logger.Sync()
 
-	config, err := LoadConfig(configPath)
+	if configPath == "" {
+		if _, err := os.Stat(defaultConfigPath); err == nil {
+			configPath = defaultConfigPath
+		}
+	}
+	config, err := LoadConfig(configPath, configFlags)
 
 	if err != nil {
 		logger.Fatal("Failed to load config", zap.Error(err))
 	}
+	applyLogLevel(level, config)
+	if config.Relay.Reconcile != nil {
+		logger.Warn("relay.reconcile is deprecated, use reconcile instead")
+	}
+	// the ambient token of CI environments isn't picked up, so statuses aren't posted with unintended permissions
+	if config.GithubStatus.Enabled && config.GithubStatus.Token == "" && os.Getenv("GITHUB_TOKEN") != "" {
+		logger.Warn("GITHUB_TOKEN is ignored, set AUTORECONCILER_GITHUB_STATUS_TOKEN for GitHub statuses")
+	}
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
@@ -118,15 +318,28 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
 
+	shutdownTracing := setupTracing(ctx, config, logger)
+	watcher := newConfigWatcher(ctx, configPath, configFlags, config, level, logger)
+
+	// internal endpoints are served by the metrics server
+	adminMux := http.NewServeMux()
+
+	leader := newLeaderElector(ctx, config, logger)
+	health := newHealth(config, leader, logger)
+	health.Handle(adminMux)
+
 	wg.Add(1)
-	if config.Mode == "server" {
-		go runServer(ctx, wg, config, logger)
-	} else {
-		go runClient(ctx, wg, config, logger)
+	switch config.Mode {
+	case "server":
+		go runServer(ctx, wg, config, leader, health, adminMux, watcher, logger)
+	case "relay":
+		go runRelay(ctx, wg, config, leader, health, adminMux, watcher, logger)
+	default:
+		go runClient(ctx, wg, config, leader, health, watcher, logger)
 	}
 
 	if config.Metrics.Enabled {
-		go runMetricsServer(ctx, config, logger)
+		go runMetricsServer(ctx, config, adminMux, logger)
 	}
 
 	go func() {
@@ -136,4 +349,11 @@ func main() {
 	}()
 
 	wg.Wait()
+
+	// flush spans of the last events, the exporter may be unreachable
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancelTracing()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		logger.Warn("Failed to flush traces", zap.Error(err))
+	}
 }
@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const metricsNamespace = "flux_reconciler"
 
+// Buckets of end-to-end latencies, from 5ms to about 40s, events pass through relays and reconnecting clients
+var latencyBuckets = prometheus.ExponentialBuckets(0.005, 2, 14)
+
 var (
 	clientsConnected = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: fmt.Sprintf("%s_clients_connected", metricsNamespace),
@@ -20,7 +27,7 @@ var (
 	reconciledCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: fmt.Sprintf("%s_reconciliations_total", metricsNamespace),
 		Help: "The total number of reconciliations",
-	}, []string{"name", "status", "namespace"})
+	}, []string{"name", "status", "namespace", "kind"})
 
 	processedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: fmt.Sprintf("%s_processed_messages_total", metricsNamespace),
@@ -34,20 +41,100 @@ var (
 
 	webhooksHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: fmt.Sprintf("%s_webhooks_handled_total", metricsNamespace),
-		Help: "The total number of processed messages",
+		Help: "The total number of handled webhook requests",
+	}, []string{"status", "provider", "event"})
+
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    fmt.Sprintf("%s_webhook_duration_seconds", metricsNamespace),
+		Help:    "Time spent handling webhook requests, including local reconciliation",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"status", "provider", "event"})
+
+	fanoutLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    fmt.Sprintf("%s_fanout_latency_seconds", metricsNamespace),
+		Help:    "Time from receiving the webhook until the event is sent to a subscriber",
+		Buckets: latencyBuckets,
+	}, []string{"client", "transport"})
+
+	subscriberQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_subscriber_queue_depth", metricsNamespace),
+		Help: "The number of events queued for sending to a subscriber",
+	}, []string{"client_id", "client"})
+
+	reconcileLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    fmt.Sprintf("%s_push_to_reconcile_latency_seconds", metricsNamespace),
+		Help:    "Time from receiving the webhook until reconciliation of an object is requested",
+		Buckets: latencyBuckets,
+	}, []string{"kind", "provider"})
+
+	readyLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    fmt.Sprintf("%s_push_to_ready_latency_seconds", metricsNamespace),
+		Help:    "Time from receiving the webhook until a reconciled object reports readiness",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+	}, []string{"kind", "namespace"})
+
+	readyTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_ready_timeouts_total", metricsNamespace),
+		Help: "The total number of reconciled objects that didn't become ready within the timeout",
+	}, []string{"kind", "namespace"})
+
+	notificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_notifications_sent_total", metricsNamespace),
+		Help: "The total number of notifications sent to notifiers",
+	}, []string{"notifier", "status"})
+
+	kubernetesRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    fmt.Sprintf("%s_kubernetes_request_duration_seconds", metricsNamespace),
+		Help:    "Duration of Kubernetes API requests",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"verb", "resource", "code"})
+
+	subscriptionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_subscriptions_total", metricsNamespace),
+		Help: "The total number of accepted subscriptions by client identity",
+	}, []string{"client"})
+
+	signaturesValidated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_webhook_signatures_validated_total", metricsNamespace),
+		Help: "The total number of webhook signatures validated by each secret",
+	}, []string{"secret"})
+
+	eventBusMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_event_bus_messages_total", metricsNamespace),
+		Help: "The total number of events published to and received from the event bus",
+	}, []string{"operation", "status"})
+
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_leader", metricsNamespace),
+		Help: "Whether this replica is the elected leader reconciling sources",
+	})
+
+	subscriberResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_subscriber_results_total", metricsNamespace),
+		Help: "The total number of reconciliation results reported by subscribers",
+	}, []string{"client", "status"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_config_reloads_total", metricsNamespace),
+		Help: "The total number of config reloads, failed reloads keep the active config",
 	}, []string{"status"})
+
+	configInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_config_info", metricsNamespace),
+		Help: "Hash of the active config and the files it references, always 1",
+	}, []string{"hash"})
 )
 
-func runMetricsServer(ctx context.Context, config Config, logger *zap.Logger) {
+// runMetricsServer serves metrics on the given mux, which other components may use for internal admin endpoints
+func runMetricsServer(ctx context.Context, config Config, mux *http.ServeMux, logger *zap.Logger) {
 	setupMetrics(config)
 	addr := fmt.Sprintf("%s:%s", config.Metrics.Host, config.Metrics.Port)
-	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 	server := &http.Server{Addr: addr, Handler: mux}
 	go func() {
 		logger.Info("Starting metrics server", zap.String("addr", addr))
 		err := server.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Fatal("Failed to start server metrics", zap.Error(err))
 		}
 	}()
@@ -62,11 +149,90 @@ func runMetricsServer(ctx context.Context, config Config, logger *zap.Logger) {
 
 func setupMetrics(config Config) {
 	prometheus.MustRegister(reconciledCount)
-	if config.Mode == "server" { // server only metrics
+	prometheus.MustRegister(reconcileLatency)
+	prometheus.MustRegister(kubernetesRequestDuration)
+	prometheus.MustRegister(configInfo)
+	if *config.Reload.Enabled {
+		prometheus.MustRegister(configReloads)
+	}
+	if config.LeaderElection.Enabled {
+		prometheus.MustRegister(leaderGauge)
+	}
+	if config.ReadyTracking.Enabled {
+		prometheus.MustRegister(readyLatency)
+		prometheus.MustRegister(readyTimeouts)
+	}
+	if config.Mode != "client" { // server and relay metrics
 		prometheus.MustRegister(clientsConnected)
+		prometheus.MustRegister(subscriptionsTotal)
 		prometheus.MustRegister(webhooksHandled)
-	} else { // client only metrics
+		prometheus.MustRegister(webhookDuration)
+		prometheus.MustRegister(fanoutLatency)
+		prometheus.MustRegister(subscriberQueueDepth)
+		prometheus.MustRegister(signaturesValidated)
+		prometheus.MustRegister(subscriberResults)
+		prometheus.MustRegister(eventBusMessages)
+		prometheus.MustRegister(notificationsSent)
+	}
+	if config.Mode != "server" { // client and relay metrics
 		prometheus.MustRegister(processedMessages)
 		prometheus.MustRegister(connectionAttempts)
 	}
 }
+
+// webhookEvents are the GitHub event types labeled by name, the header is set by callers so others are labeled "other"
+var webhookEvents = map[string]bool{"package": true, "registry_package": true, "ping": true}
+
+// webhookLabels returns labels of webhook metrics for the request, GitHub announces the event type in a header
+func webhookLabels(r *http.Request, status string) prometheus.Labels {
+	event := r.Header.Get("X-GitHub-Event")
+	switch {
+	case event == "":
+		event = "unknown"
+	case !webhookEvents[event]:
+		event = "other"
+	}
+	return prometheus.Labels{"status": status, "provider": providerGithub, "event": event}
+}
+
+// instrumentedTransport records the duration of Kubernetes API requests
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	kubernetesRequestDuration.With(prometheus.Labels{
+		"verb":     req.Method,
+		"resource": kubernetesResource(req.URL.Path),
+		"code":     code,
+	}).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// kubernetesResource extracts the resource from a Kubernetes API path, e.g. ocirepositories
+// from /apis/source.toolkit.fluxcd.io/v1beta2/namespaces/default/ocirepositories/app
+func kubernetesResource(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) > 0 && parts[0] == "api":
+		parts = parts[min(len(parts), 2):]
+	case len(parts) > 0 && parts[0] == "apis":
+		parts = parts[min(len(parts), 3):]
+	default:
+		// non-resource paths like /readyz or /version
+		return path
+	}
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+	if len(parts) == 0 {
+		return "discovery"
+	}
+	return parts[0]
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "registry package", header: "registry_package", want: "registry_package"},
+		{name: "package", header: "package", want: "package"},
+		{name: "ping", header: "ping", want: "ping"},
+		{name: "missing header", want: "unknown"},
+		{name: "other GitHub event", header: "push", want: "other"},
+		{name: "junk header", header: "x1f9c3e7a-random", want: "other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			if test.header != "" {
+				r.Header.Set("X-GitHub-Event", test.header)
+			}
+			if got := webhookLabels(r, "success")["event"]; got != test.want {
+				t.Errorf("event label %q, want %q", got, test.want)
+			}
+		})
+	}
+}
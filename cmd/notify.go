@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifierFlux    = "flux"
+	notifierGeneric = "generic"
+	notifierSlack   = "slack"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeNoop    = "noop"
+
+	// How long results of clusters are collected when the config doesn't specify it
+	defaultNotificationWindow = 30 * time.Second
+
+	// Time allowed for delivering a notification to a single notifier
+	notifyTimeout = 10 * time.Second
+
+	// Reporting controller of events sent to Flux notification-controller
+	notificationController = "flux-webhook-autoreconciler"
+)
+
+// API versions of reconciled kinds, Flux notification-controller needs them to route events
+var kindAPIVersions = map[string]string{
+	kindOCIRepository:         "source.toolkit.fluxcd.io/v1beta2",
+	kindImageRepository:       "image.toolkit.fluxcd.io/v1beta2",
+	kindImageUpdateAutomation: "image.toolkit.fluxcd.io/v1beta1",
+}
+
+// NotifierConfig is a target notified of the outcome of every event
+type NotifierConfig struct {
+	Name string `yaml:"name" validate:"required"`
+	// Type is the payload format: flux sends events to Flux notification-controller, generic sends the summary as JSON,
+	// slack sends a message to a Slack-compatible incoming webhook
+	Type string `yaml:"type" validate:"required,oneof=flux generic slack"`
+	URL  string `yaml:"url" validate:"required,url"`
+	// Outcomes restricts notifications to events with these outcomes, empty means all outcomes
+	Outcomes []string `yaml:"outcomes" validate:"dive,oneof=success failure noop"`
+}
+
+// EventSummary describes what happened to an event in every cluster it reached
+type EventSummary struct {
+	EventId    string     `json:"eventId"`
+	Source     string     `json:"source"`
+	Tag        string     `json:"tag"`
+	Provider   string     `json:"provider"`
+	Repository string     `json:"repository,omitempty"`
+	Revision   string     `json:"revision,omitempty"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	Outcome    string     `json:"outcome"`
+	// Failures is the number of objects that failed to reconcile in all clusters
+	Failures int              `json:"failures"`
+	Clusters []ClusterSummary `json:"clusters"`
+}
+
+// ClusterSummary is the outcome of an event in a single cluster.
+// Clients that don't report results are listed with Reported false.
+type ClusterSummary struct {
+	Cluster  string            `json:"cluster"`
+	Client   string            `json:"client"`
+	Reported bool              `json:"reported"`
+	Results  []ReconcileResult `json:"results,omitempty"`
+}
+
+// outcome is failure if any object failed to reconcile, success if any object was reconciled and noop otherwise.
+// It returns the number of failed objects too.
+func (s EventSummary) outcome() (string, int) {
+	reconciled, failures := 0, 0
+	for _, cluster := range s.Clusters {
+		for _, result := range cluster.Results {
+			if result.Error != "" {
+				failures++
+			}
+			reconciled++
+		}
+	}
+	switch {
+	case failures > 0:
+		return outcomeFailure, failures
+	case reconciled > 0:
+		return outcomeSuccess, 0
+	}
+	return outcomeNoop, 0
+}
+
+// pendingSummary collects results of an event until every reporting cluster reported or the window expires
+type pendingSummary struct {
+	summary EventSummary
+	// index of clusters in the summary by reporter ID
+	clusters map[string]int
+	// number of reporters that haven't reported yet
+	waiting int
+	timer   *time.Timer
+}
+
+// Notifier collects the outcome of events in the clusters they reached and notifies the configured targets
+type Notifier struct {
+	httpClient *http.Client
+	logger     *zap.Logger
+
+	m         sync.Mutex
+	notifiers []NotifierConfig
+	// github is nil without reporting to GitHub
+	github  *GithubReporter
+	window  time.Duration
+	pending map[string]*pendingSummary
+	// events notified within the last window, events delivered late by the event bus aren't notified twice
+	notified map[string]bool
+	sending  sync.WaitGroup
+
+	// instanceId identifies this replica, events received from other replicas are notified by the replica that received them
+	instanceId string
+	// forward sends reports of events other replicas received to them
+	forward func(report ReportMessage)
+	// replicas that received events reported to them by ID of the event, kept for a window
+	forwarded map[string]string
+}
+
+// NewNotifier creates a notifier, which ignores all events while no notifiers and no GitHub reporting are configured.
+// A nil notifier ignores all events too. Reports of events received by other replicas are sent to them with forward.
+func NewNotifier(config Config, forward func(report ReportMessage), logger *zap.Logger) *Notifier {
+	n := &Notifier{
+		httpClient: &http.Client{Timeout: notifyTimeout},
+		logger:     logger,
+		pending:    make(map[string]*pendingSummary),
+		notified:   make(map[string]bool),
+		forward:    forward,
+		forwarded:  make(map[string]string),
+	}
+	n.Reload(config)
+	return n
+}
+
+// Reload replaces the notified targets and the window, events already collected are notified with the new targets
+func (n *Notifier) Reload(config Config) {
+	if n == nil {
+		return
+	}
+	github := NewGithubReporter(config, n.logger)
+
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.notifiers = config.Notifications.Notifiers
+	n.github = github
+	n.window = config.Notifications.Window
+	n.instanceId = config.InstanceId
+}
+
+// Reached records that the event was sent to a cluster. Reporters are waited for until they report results.
+// Events another replica received are forwarded to it along with the results reported later.
+func (n *Notifier) Reached(event SubscribeEventPayload, reporterId string, cluster string, client string, reports bool) {
+	if n == nil || event.Id == "" {
+		return
+	}
+	n.m.Lock()
+	if len(n.notifiers) == 0 && n.github == nil {
+		n.m.Unlock()
+		return
+	}
+	if origin := event.origin(); origin != "" && origin != n.instanceId && n.forward != nil {
+		if _, ok := n.forwarded[event.Id]; !ok {
+			n.forwarded[event.Id] = origin
+			time.AfterFunc(n.window, func() {
+				n.m.Lock()
+				delete(n.forwarded, event.Id)
+				n.m.Unlock()
+			})
+		}
+		n.m.Unlock()
+		n.forward(ReportMessage{Origin: origin, Reporter: reporterId, Event: &event, Cluster: cluster, Client: client, Reports: reports})
+		return
+	}
+	defer n.m.Unlock()
+
+	if n.notified[event.Id] {
+		return
+	}
+	pending, ok := n.pending[event.Id]
+	if !ok {
+		pending = &pendingSummary{
+			summary: EventSummary{
+				EventId:    event.Id,
+				Source:     event.OciUrl,
+				Tag:        event.Tag,
+				Provider:   event.provider(),
+				Repository: event.Repository,
+				Revision:   event.Revision,
+				ReceivedAt: event.ReceivedAt,
+			},
+			clusters: make(map[string]int),
+		}
+		pending.timer = time.AfterFunc(n.window, func() { n.flush(event.Id) })
+		n.pending[event.Id] = pending
+	}
+	if _, ok := pending.clusters[reporterId]; ok {
+		return
+	}
+	pending.clusters[reporterId] = len(pending.summary.Clusters)
+	pending.summary.Clusters = append(pending.summary.Clusters, ClusterSummary{Cluster: cluster, Client: client})
+	if reports {
+		pending.waiting++
+	}
+}
+
+// Report records results of the event reported by a cluster, the summary is sent once all reporters reported.
+// Results of events another replica received are forwarded to it.
+func (n *Notifier) Report(eventId string, reporterId string, results []ReconcileResult) {
+	if n == nil {
+		return
+	}
+	n.m.Lock()
+	if origin, ok := n.forwarded[eventId]; ok {
+		n.m.Unlock()
+		n.forward(ReportMessage{Origin: origin, Reporter: reporterId, EventId: eventId, Results: results})
+		return
+	}
+	pending, ok := n.pending[eventId]
+	if !ok {
+		// reported after the window expired
+		n.m.Unlock()
+		return
+	}
+	i, ok := pending.clusters[reporterId]
+	if !ok || pending.summary.Clusters[i].Reported {
+		n.m.Unlock()
+		return
+	}
+	pending.summary.Clusters[i].Reported = true
+	pending.summary.Clusters[i].Results = results
+	pending.waiting--
+	done := pending.waiting <= 0
+	n.m.Unlock()
+
+	if done {
+		n.flush(eventId)
+	}
+}
+
+// Flush sends summaries of all pending events, reporters that didn't report yet are listed as not reported,
+// and waits until notifications are sent or the context is done
+func (n *Notifier) Flush(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	n.m.Lock()
+	ids := make([]string, 0, len(n.pending))
+	for id := range n.pending {
+		ids = append(ids, id)
+	}
+	n.m.Unlock()
+
+	for _, id := range ids {
+		n.flush(id)
+	}
+	return waitContext(ctx, &n.sending)
+}
+
+func (n *Notifier) flush(eventId string) {
+	n.m.Lock()
+	notifiers, github := n.notifiers, n.github
+	pending, ok := n.pending[eventId]
+	if ok {
+		delete(n.pending, eventId)
+		pending.timer.Stop()
+		n.notified[eventId] = true
+		time.AfterFunc(n.window, func() {
+			n.m.Lock()
+			delete(n.notified, eventId)
+			n.m.Unlock()
+		})
+	}
+	n.m.Unlock()
+	if !ok {
+		return
+	}
+
+	summary := pending.summary
+	summary.Outcome, summary.Failures = summary.outcome()
+	for _, notifier := range notifiers {
+		if len(notifier.Outcomes) > 0 && !contains(notifier.Outcomes, summary.Outcome) {
+			continue
+		}
+		n.sending.Add(1)
+		go func(notifier NotifierConfig) {
+			defer n.sending.Done()
+			n.notify(notifier, summary)
+		}(notifier)
+	}
+	if github != nil {
+		n.sending.Add(1)
+		go func() {
+			defer n.sending.Done()
+			n.reportGithub(github, summary)
+		}()
+	}
+}
+
+func (n *Notifier) reportGithub(github *GithubReporter, summary EventSummary) {
+	if err := github.Report(summary); err != nil {
+		n.logger.Error("Failed to report status to GitHub", zap.Error(err), zap.String("eventId", summary.EventId), zap.String("repository", summary.Repository))
+		notificationsSent.With(prometheus.Labels{"notifier": "github", "status": "fail"}).Inc()
+		return
+	}
+	notificationsSent.With(prometheus.Labels{"notifier": "github", "status": "success"}).Inc()
+}
+
+func (n *Notifier) notify(notifier NotifierConfig, summary EventSummary) {
+	var payloads []interface{}
+	switch notifier.Type {
+	case notifierFlux:
+		for _, event := range fluxEvents(summary) {
+			payloads = append(payloads, event)
+		}
+	case notifierSlack:
+		payloads = append(payloads, slackMessage(summary))
+	default:
+		payloads = append(payloads, summary)
+	}
+
+	for _, payload := range payloads {
+		err := n.post(notifier.URL, payload)
+		if err != nil {
+			n.logger.Error("Failed to send notification", zap.Error(err), zap.String("notifier", notifier.Name), zap.String("eventId", summary.EventId))
+			notificationsSent.With(prometheus.Labels{"notifier": notifier.Name, "status": "fail"}).Inc()
+			continue
+		}
+		notificationsSent.With(prometheus.Labels{"notifier": notifier.Name, "status": "success"}).Inc()
+	}
+}
+
+func (n *Notifier) post(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// fluxEvent is the event format of Flux controllers accepted by notification-controller,
+// which routes it to providers of alerts matching the involved object
+type fluxEvent struct {
+	InvolvedObject struct {
+		Kind       string `json:"kind"`
+		Namespace  string `json:"namespace"`
+		Name       string `json:"name"`
+		APIVersion string `json:"apiVersion"`
+	} `json:"involvedObject"`
+	Severity            string            `json:"severity"`
+	Timestamp           time.Time         `json:"timestamp"`
+	Message             string            `json:"message"`
+	Reason              string            `json:"reason"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+	ReportingController string            `json:"reportingController"`
+	ReportingInstance   string            `json:"reportingInstance,omitempty"`
+}
+
+// fluxEvents returns an event for every object reconciled in any cluster.
+// Metadata keys are prefixed with the API group, notification-controller drops other keys.
+func fluxEvents(summary EventSummary) []fluxEvent {
+	var events []fluxEvent
+	for _, cluster := range summary.Clusters {
+		for _, result := range cluster.Results {
+			event := fluxEvent{
+				Severity:            "info",
+				Timestamp:           time.Now().UTC(),
+				Reason:              "ReconcileRequested",
+				Message:             fmt.Sprintf("Reconciliation requested for %s:%s in cluster %s", summary.Source, summary.Tag, cluster.Cluster),
+				ReportingController: notificationController,
+				ReportingInstance:   cluster.Client,
+			}
+			if result.Error != "" {
+				event.Severity = "error"
+				event.Reason = "ReconcileRequestFailed"
+				event.Message = fmt.Sprintf("Failed to request reconciliation for %s:%s in cluster %s: %s", summary.Source, summary.Tag, cluster.Cluster, result.Error)
+			}
+			apiVersion := kindAPIVersions[result.Kind]
+			event.InvolvedObject.Kind = result.Kind
+			event.InvolvedObject.Namespace = result.Namespace
+			event.InvolvedObject.Name = result.Name
+			event.InvolvedObject.APIVersion = apiVersion
+			group := strings.Split(apiVersion, "/")[0]
+			event.Metadata = map[string]string{
+				group + "/cluster": cluster.Cluster,
+				group + "/tag":     summary.Tag,
+				group + "/eventId": summary.EventId,
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// slackMessage formats the summary as a message for Slack-compatible incoming webhooks
+func slackMessage(summary EventSummary) map[string]string {
+	var text strings.Builder
+	reported := 0
+	for _, cluster := range summary.Clusters {
+		if cluster.Reported {
+			reported++
+		}
+	}
+
+	switch summary.Outcome {
+	case outcomeFailure:
+		text.WriteString(":x: ")
+	case outcomeSuccess:
+		text.WriteString(":white_check_mark: ")
+	default:
+		text.WriteString(":information_source: ")
+	}
+	fmt.Fprintf(&text, "`%s:%s` reached %d clusters, %d reported results", summary.Source, summary.Tag, len(summary.Clusters), reported)
+	for _, cluster := range summary.Clusters {
+		for _, result := range cluster.Results {
+			if result.Error != "" {
+				fmt.Fprintf(&text, "\n• %s: %s %s/%s failed: %s", cluster.Cluster, result.Kind, result.Namespace, result.Name, result.Error)
+			}
+		}
+	}
+	return map[string]string{"text": text.String()}
+}
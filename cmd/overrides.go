@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Prefix of environment variables overriding config settings
+const envPrefix = "AUTORECONCILER_"
+
+// configSetting is a config field overridden by environment variables and a flag named after its YAML path,
+// e.g. eventBus.redis.address by AUTORECONCILER_EVENT_BUS_REDIS_ADDRESS and --event-bus.redis.address
+type configSetting struct {
+	path  string
+	index []int
+	// env are names of environment variables in increasing precedence, the name from the env tag comes first
+	env  []string
+	flag string
+	// secret settings may be read from files named by variables with the _FILE suffix and flags with the -file suffix
+	secret  bool
+	boolean bool
+}
+
+// configSettings are all settings of the config. Structs are settings of their fields, lists are set as a whole.
+var configSettings = settingsOf(reflect.TypeOf(Config{}), nil, nil)
+
+func settingsOf(t reflect.Type, path []string, index []int) []configSetting {
+	var settings []configSetting
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), name)
+		fieldIndex := append(append([]int{}, index...), i)
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			settings = append(settings, settingsOf(field.Type, fieldPath, fieldIndex)...)
+			continue
+		}
+
+		setting := configSetting{
+			path:    strings.Join(fieldPath, "."),
+			index:   fieldIndex,
+			secret:  field.Tag.Get("secret") == "true",
+			boolean: field.Type.Kind() == reflect.Bool || field.Type == reflect.TypeOf((*bool)(nil)),
+		}
+		if alias := field.Tag.Get("env"); alias != "" {
+			setting.env = append(setting.env, alias)
+		}
+		var envWords, flagWords []string
+		for _, key := range fieldPath {
+			envWords = append(envWords, strings.ToUpper(strings.Join(words(key), "_")))
+			flagWords = append(flagWords, strings.Join(words(key), "-"))
+		}
+		setting.env = append(setting.env, envPrefix+strings.Join(envWords, "_"))
+		setting.flag = strings.Join(flagWords, ".")
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// words splits a camelCase key into lowercase words, e.g. clientCAFile into client, ca and file
+func words(key string) []string {
+	runes := []rune(key)
+	var result []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		if unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			result = append(result, strings.ToLower(string(runes[start:i])))
+			start = i
+		}
+	}
+	return append(result, strings.ToLower(string(runes[start:])))
+}
+
+// ConfigFlags are values of command line flags overriding config settings by flag name
+type ConfigFlags map[string]string
+
+// Register adds a flag for every config setting to the flag set
+func (f ConfigFlags) Register(fs *flag.FlagSet) {
+	for _, setting := range configSettings {
+		fs.Var(&settingFlag{name: setting.flag, values: f, boolean: setting.boolean}, setting.flag, fmt.Sprintf("Overrides %s", setting.path))
+		if setting.secret {
+			fs.Var(&settingFlag{name: setting.flag + "-file", values: f}, setting.flag+"-file", fmt.Sprintf("Reads %s from the file", setting.path))
+		}
+	}
+}
+
+// settingFlag records the value of a flag that was set
+type settingFlag struct {
+	name    string
+	values  ConfigFlags
+	boolean bool
+}
+
+func (f *settingFlag) String() string {
+	return ""
+}
+
+func (f *settingFlag) Set(value string) error {
+	f.values[f.name] = value
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// applyOverrides sets settings from environment variables and then from flags, so flags take precedence.
+// Empty environment variables are ignored. Files secrets are read from are recorded in the config.
+func (c *Config) applyOverrides(flags ConfigFlags) error {
+	lookupEnv := func(name string) (string, bool) {
+		value := os.Getenv(name)
+		return value, value != ""
+	}
+	lookupFlag := func(name string) (string, bool) {
+		value, ok := flags[name]
+		return value, ok
+	}
+
+	root := reflect.ValueOf(c).Elem()
+	for _, setting := range configSettings {
+		var value, file string
+		set := false
+		for _, name := range setting.env {
+			v, f, ok, err := lookupSetting(lookupEnv, name, name+"_FILE", setting.secret)
+			if err != nil {
+				return err
+			}
+			if ok {
+				value, file, set = v, f, true
+			}
+		}
+		v, f, ok, err := lookupSetting(lookupFlag, setting.flag, setting.flag+"-file", setting.secret)
+		if err != nil {
+			return err
+		}
+		if ok {
+			value, file, set = v, f, true
+		}
+
+		if !set {
+			continue
+		}
+		if err := setValue(root.FieldByIndex(setting.index), value); err != nil {
+			return fmt.Errorf("invalid value of %s: %w", setting.path, err)
+		}
+		if file != "" {
+			c.secretFiles = append(c.secretFiles, file)
+		}
+	}
+	return nil
+}
+
+// lookupSetting returns the value named name, or the contents of the file named by fileName for secrets.
+// It returns the name of the file the value was read from, if any.
+func lookupSetting(lookup func(name string) (string, bool), name string, fileName string, secret bool) (string, string, bool, error) {
+	value, ok := lookup(name)
+	if !secret {
+		return value, "", ok, nil
+	}
+	file, fileOk := lookup(fileName)
+	if !fileOk {
+		return value, "", ok, nil
+	}
+	if ok {
+		return "", "", false, fmt.Errorf("both %s and %s are set", name, fileName)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", false, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), file, true, nil
+}
+
+// setValue sets the field from its string representation. Strings are taken as they are, lists of strings
+// may be comma-separated, and other values, including lists of objects, are parsed as YAML.
+func setValue(field reflect.Value, value string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+		return nil
+	case field.Type() == reflect.TypeOf([]string(nil)) && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		var values []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+		return nil
+	}
+
+	target := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(value), target.Interface()); err != nil {
+		return err
+	}
+	field.Set(target.Elem())
+	return nil
+}
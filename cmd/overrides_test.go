@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "mode", want: []string{"mode"}},
+		{key: "githubSecret", want: []string{"github", "secret"}},
+		{key: "clientCAFile", want: []string{"client", "ca", "file"}},
+		{key: "hmacKey", want: []string{"hmac", "key"}},
+		{key: "JWKSFile", want: []string{"jwks", "file"}},
+		{key: "apiUrl", want: []string{"api", "url"}},
+		{key: "s3Bucket", want: []string{"s3", "bucket"}},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := words(test.key); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("words(%q) = %q, want %q", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  interface{}
+		value   string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "string", target: new(string), value: "a, b", want: "a, b"},
+		{name: "comma-separated list", target: new([]string), value: "a, b,,c", want: []string{"a", "b", "c"}},
+		{name: "YAML list", target: new([]string), value: "[a, 'b,c']", want: []string{"a", "b,c"}},
+		{name: "bool", target: new(bool), value: "true", want: true},
+		{name: "bool pointer", target: new(*bool), value: "false", want: func() *bool { v := false; return &v }()},
+		{name: "int", target: new(int), value: "3", want: 3},
+		{name: "duration", target: new(time.Duration), value: "1m30s", want: 90 * time.Second},
+		{
+			name:   "list of objects",
+			target: new([]WebhookSecret),
+			value:  `[{name: primary, secret: s3cr3t}]`,
+			want:   []WebhookSecret{{Name: "primary", Secret: "s3cr3t"}},
+		},
+		{name: "invalid int", target: new(int), value: "three", wantErr: true},
+		{name: "invalid duration", target: new(time.Duration), value: "soon", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			field := reflect.ValueOf(test.target).Elem()
+			err := setValue(field, test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(field.Interface(), test.want) {
+				t.Errorf("set %#v, want %#v", field.Interface(), test.want)
+			}
+		})
+	}
+}
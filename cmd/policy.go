@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	sourceController "github.com/fluxcd/source-controller/api/v1beta2"
+	"go.uber.org/zap"
+	apiMeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// How often policy statuses are recalculated.
+	policyStatusInterval = time.Minute
+
+	// How often the policy informer resyncs its cache.
+	policyResyncPeriod = 10 * time.Minute
+)
+
+const (
+	kindOCIRepository         = "OCIRepository"
+	kindImageRepository       = "ImageRepository"
+	kindImageUpdateAutomation = "ImageUpdateAutomation"
+)
+
+// errPoliciesNotSynced is returned while the policy cache is empty because it hasn't synced yet
+var errPoliciesNotSynced = errors.New("AutoReconcilePolicy cache not synced yet")
+
+var autoReconcilePoliciesResource = schema.GroupVersionResource{
+	Group:    "autoreconcile.codex.so",
+	Version:  "v1alpha1",
+	Resource: "autoreconcilepolicies",
+}
+
+// AutoReconcilePolicy is a namespaced resource that lets tenants declare which of their sources are reconciled
+// and on which events. Namespaces without policies keep the behavior defined by the global config.
+type AutoReconcilePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AutoReconcilePolicySpec   `json:"spec"`
+	Status AutoReconcilePolicyStatus `json:"status,omitempty"`
+}
+
+type AutoReconcilePolicySpec struct {
+	// SourceSelector selects sources of the namespace by their labels. Empty selector matches all sources.
+	SourceSelector *metav1.LabelSelector `json:"sourceSelector,omitempty"`
+
+	// Providers is a list of event providers allowed to trigger reconciliation. Empty list allows all providers.
+	Providers []string `json:"providers,omitempty"`
+
+	// Tags filters events by the pushed tag using glob patterns.
+	Tags PolicyTagFilter `json:"tags,omitempty"`
+
+	// Cascade enables reconciliation of image automation objects related to the pushed image.
+	Cascade PolicyCascade `json:"cascade,omitempty"`
+}
+
+type PolicyTagFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type PolicyCascade struct {
+	ImageRepositories      bool `json:"imageRepositories,omitempty"`
+	ImageUpdateAutomations bool `json:"imageUpdateAutomations,omitempty"`
+}
+
+type AutoReconcilePolicyStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	MatchedSources     int                `json:"matchedSources"`
+	LastTriggeredTime  *metav1.Time       `json:"lastTriggeredTime,omitempty"`
+}
+
+// validate checks that all patterns of the policy are well-formed
+func (p *AutoReconcilePolicy) validate() error {
+	if _, err := metav1.LabelSelectorAsSelector(p.Spec.SourceSelector); err != nil {
+		return fmt.Errorf("invalid source selector: %w", err)
+	}
+	for _, pattern := range append(p.Spec.Tags.Include, p.Spec.Tags.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid tag pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// selects reports whether the policy covers an object of the given kind with the given labels
+func (p *AutoReconcilePolicy) selects(kind string, objectLabels map[string]string) bool {
+	switch kind {
+	case kindImageRepository:
+		if !p.Spec.Cascade.ImageRepositories {
+			return false
+		}
+	case kindImageUpdateAutomation:
+		// automations are not sources, so the source selector doesn't apply to them
+		return p.Spec.Cascade.ImageUpdateAutomations
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.SourceSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(objectLabels))
+}
+
+// permits reports whether the event passes provider and tag filters of the policy
+func (p *AutoReconcilePolicy) permits(event SubscribeEventPayload) bool {
+	if len(p.Spec.Providers) > 0 && !contains(p.Spec.Providers, event.provider()) {
+		return false
+	}
+	if len(p.Spec.Tags.Include) > 0 && !matchAny(p.Spec.Tags.Include, event.Tag) {
+		return false
+	}
+	return !matchAny(p.Spec.Tags.Exclude, event.Tag)
+}
+
+// PolicyStore watches AutoReconcilePolicies and answers which objects may be reconciled for an event
+type PolicyStore struct {
+	restClient    *rest.RESTClient
+	dynamicClient dynamic.Interface
+	informer      informers.GenericInformer
+	logger        *zap.Logger
+
+	m sync.Mutex
+	// times policies last allowed a reconciliation, written by the next periodic status update
+	triggered map[types.NamespacedName]metav1.Time
+}
+
+func NewPolicyStore(client *rest.RESTClient, dynamicClient dynamic.Interface, logger *zap.Logger) *PolicyStore {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, policyResyncPeriod)
+	return &PolicyStore{
+		restClient:    client,
+		dynamicClient: dynamicClient,
+		informer:      factory.ForResource(autoReconcilePoliciesResource),
+		logger:        logger,
+		triggered:     make(map[types.NamespacedName]metav1.Time),
+	}
+}
+
+// Run starts watching policies and periodically updates their statuses until the context is done
+func (s *PolicyStore) Run(ctx context.Context) {
+	go s.informer.Informer().Run(ctx.Done())
+
+	s.logger.Info("Waiting for AutoReconcilePolicy cache to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), s.informer.Informer().HasSynced) {
+		return
+	}
+	s.logger.Info("AutoReconcilePolicy cache synced")
+
+	ticker := time.NewTicker(policyStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		s.updateStatuses(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Match returns whether the namespace is governed by policies and, if so, the policies that allow
+// reconciling the object for the event. Namespaces without policies are not governed.
+// Until the cache has synced, any namespace may have policies, so it returns errPoliciesNotSynced.
+func (s *PolicyStore) Match(kind string, namespace string, objectLabels map[string]string, event SubscribeEventPayload) (bool, []AutoReconcilePolicy, error) {
+	if !s.informer.Informer().HasSynced() {
+		return false, nil, errPoliciesNotSynced
+	}
+	policies := s.list(namespace)
+	if len(policies) == 0 {
+		return false, nil, nil
+	}
+
+	var matched []AutoReconcilePolicy
+	for _, policy := range policies {
+		if policy.validate() != nil {
+			continue
+		}
+		if policy.selects(kind, objectLabels) && policy.permits(event) {
+			matched = append(matched, policy)
+		}
+	}
+	return true, matched, nil
+}
+
+// CascadesImages reports whether any policy enables ImageRepository reconciliation
+func (s *PolicyStore) CascadesImages() bool {
+	for _, policy := range s.list("") {
+		if policy.Spec.Cascade.ImageRepositories {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkTriggered records the time the policies last allowed a reconciliation. Statuses are patched
+// by the periodic status update, so a burst of events doesn't patch every policy for each event.
+func (s *PolicyStore) MarkTriggered(policies []AutoReconcilePolicy) {
+	now := metav1.Now()
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, policy := range policies {
+		s.triggered[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = now
+	}
+}
+
+// pendingTriggered returns trigger times not written to policy statuses yet
+func (s *PolicyStore) pendingTriggered() map[types.NamespacedName]metav1.Time {
+	s.m.Lock()
+	defer s.m.Unlock()
+	pending := make(map[types.NamespacedName]metav1.Time, len(s.triggered))
+	for key, triggered := range s.triggered {
+		pending[key] = triggered
+	}
+	return pending
+}
+
+// clearTriggered forgets the trigger time once it is written, unless the policy was triggered again since
+func (s *PolicyStore) clearTriggered(key types.NamespacedName, written metav1.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if triggered, ok := s.triggered[key]; ok && triggered.Equal(&written) {
+		delete(s.triggered, key)
+	}
+}
+
+func (s *PolicyStore) list(namespace string) []AutoReconcilePolicy {
+	var objects []runtime.Object
+	var err error
+	if namespace == "" {
+		objects, err = s.informer.Lister().List(labels.Everything())
+	} else {
+		objects, err = s.informer.Lister().ByNamespace(namespace).List(labels.Everything())
+	}
+	if err != nil {
+		s.logger.Error("Failed to list AutoReconcilePolicies", zap.Error(err))
+		return nil
+	}
+
+	policies := make([]AutoReconcilePolicy, 0, len(objects))
+	for _, object := range objects {
+		u, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		var policy AutoReconcilePolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &policy); err != nil {
+			s.logger.Error("Failed to decode AutoReconcilePolicy", zap.Error(err), zap.String("name", u.GetName()), zap.String("namespace", u.GetNamespace()))
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// updateStatuses recalculates the number of sources covered by each policy and its Ready condition,
+// and writes the times policies last triggered a reconciliation
+func (s *PolicyStore) updateStatuses(ctx context.Context) {
+	triggered := s.pendingTriggered()
+	policies := s.list("")
+	for key, written := range triggered {
+		// deleted policies don't need their status updated
+		if !containsPolicy(policies, key) {
+			s.clearTriggered(key, written)
+		}
+	}
+	if len(policies) == 0 {
+		return
+	}
+
+	var ociRepositories sourceController.OCIRepositoryList
+	err := s.restClient.Get().Resource("ocirepositories").Namespace("").Do(ctx).Into(&ociRepositories)
+	if err != nil {
+		s.logger.Error("Failed to get OCIRepositories", zap.Error(err))
+		return
+	}
+
+	var imageRepositories []unstructured.Unstructured
+	if s.CascadesImages() {
+		list, err := s.dynamicClient.Resource(imageRepositoriesResource).Namespace("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			s.logger.Error("Failed to get ImageRepositories", zap.Error(err))
+		} else {
+			imageRepositories = list.Items
+		}
+	}
+
+	for _, policy := range policies {
+		condition := metav1.Condition{
+			Type:               "Ready",
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: policy.Generation,
+			Reason:             "PolicyActive",
+		}
+
+		matched := 0
+		if err := policy.validate(); err != nil {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "InvalidSpec"
+			condition.Message = err.Error()
+		} else {
+			for _, ociRepository := range ociRepositories.Items {
+				if ociRepository.Namespace == policy.Namespace && policy.selects(kindOCIRepository, ociRepository.Labels) {
+					matched++
+				}
+			}
+			for _, imageRepository := range imageRepositories {
+				if imageRepository.GetNamespace() == policy.Namespace && policy.selects(kindImageRepository, imageRepository.GetLabels()) {
+					matched++
+				}
+			}
+			condition.Message = fmt.Sprintf("Policy covers %d sources", matched)
+		}
+
+		conditions := policy.Status.Conditions
+		apiMeta.SetStatusCondition(&conditions, condition)
+
+		status := map[string]interface{}{
+			"observedGeneration": policy.Generation,
+			"conditions":         conditions,
+			"matchedSources":     matched,
+		}
+		key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+		lastTriggered, wasTriggered := triggered[key]
+		if wasTriggered {
+			status["lastTriggeredTime"] = lastTriggered
+		}
+		if err := s.patchStatus(policy, map[string]interface{}{"status": status}); err != nil {
+			s.logger.Error("Failed to update AutoReconcilePolicy status", zap.Error(err), zap.String("name", policy.Name), zap.String("namespace", policy.Namespace))
+			continue
+		}
+		if wasTriggered {
+			s.clearTriggered(key, lastTriggered)
+		}
+	}
+}
+
+func containsPolicy(policies []AutoReconcilePolicy, key types.NamespacedName) bool {
+	for _, policy := range policies {
+		if policy.Namespace == key.Namespace && policy.Name == key.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PolicyStore) patchStatus(policy AutoReconcilePolicy, patch map[string]interface{}) error {
+	patchJson, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.dynamicClient.
+		Resource(autoReconcilePoliciesResource).
+		Namespace(policy.Namespace).
+		Patch(context.Background(), policy.Name, types.MergePatchType, patchJson, metav1.PatchOptions{}, "status")
+	return err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// Latest version of the message envelope. Version 0 is the legacy protocol, where events are sent as bare payloads.
+	protocolVersion = 1
+
+	// Type of the message a client sends right after connecting to announce itself
+	messageTypeHello = "hello"
+
+	// Type of the message a server answers a hello with, carrying the negotiated version and features
+	messageTypeWelcome = "welcome"
+
+	// Type of messages carrying a SubscribeEventPayload
+	messageTypeEvent = "event"
+
+	// Type of messages a client reports reconciliation results of an event with
+	messageTypeResult = "result"
+
+	// Type of messages server replicas forward reports of an event with to the replica that received its webhook
+	messageTypeReport = "report"
+)
+
+// Features a client and server may agree on during the handshake
+const (
+	// featureResults lets the client report reconciliation results of every event
+	featureResults = "results"
+)
+
+// Protocol versions supported by this build, newest first
+var supportedProtocolVersions = []int{protocolVersion}
+
+// Envelope wraps every message of protocol version 1 and newer. Receivers ignore message types they don't know,
+// so new types can be introduced without upgrading all clusters at once.
+type Envelope struct {
+	Version   int             `json:"version"`
+	Type      string          `json:"type"`
+	Id        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+
+	// TraceContext carries the W3C trace context of event messages, so spans of the receiver join the sender's trace
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// HelloMessage is sent by a client after connecting to announce its cluster and the events it is interested in.
+// Clients that don't send it receive all events. It is sent without an envelope, so servers predating envelopes understand it.
+type HelloMessage struct {
+	Type    string              `json:"type"`
+	Cluster string              `json:"cluster,omitempty"`
+	Filters SubscriptionFilters `json:"filters"`
+
+	// Versions are envelope versions the client supports, servers send bare events to clients without any
+	Versions []int `json:"versions,omitempty"`
+
+	// Features are optional protocol features the client supports
+	Features []string `json:"features,omitempty"`
+}
+
+// WelcomeMessage is the server's answer to a hello listing supported versions
+type WelcomeMessage struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+}
+
+// ResultMessage reports reconciliation results of an event
+type ResultMessage struct {
+	EventId string            `json:"eventId"`
+	Results []ReconcileResult `json:"results"`
+}
+
+// ReportMessage forwards to the replica that received the webhook of an event what happened to the event on another replica,
+// so only that replica notifies of the outcome in every cluster. It reports either that the event reached a cluster or its results.
+type ReportMessage struct {
+	// Origin is the instance ID of the replica that received the webhook
+	Origin   string `json:"origin"`
+	Reporter string `json:"reporter"`
+
+	// Event, Cluster, Client and Reports are set when the event reached a cluster
+	Event   *SubscribeEventPayload `json:"event,omitempty"`
+	Cluster string                 `json:"cluster,omitempty"`
+	Client  string                 `json:"client,omitempty"`
+	Reports bool                   `json:"reports,omitempty"`
+
+	// EventId and Results are set when the cluster reported results
+	EventId string            `json:"eventId,omitempty"`
+	Results []ReconcileResult `json:"results,omitempty"`
+}
+
+// negotiate picks the newest envelope version and the features both sides support.
+// Version 0 means the client only understands bare events.
+func negotiate(hello HelloMessage, features []string) WelcomeMessage {
+	welcome := WelcomeMessage{}
+	for _, version := range supportedProtocolVersions {
+		if containsVersion(hello.Versions, version) {
+			welcome.Version = version
+			break
+		}
+	}
+	if welcome.Version == 0 {
+		return welcome
+	}
+	for _, feature := range hello.Features {
+		if contains(features, feature) {
+			welcome.Features = append(welcome.Features, feature)
+		}
+	}
+	return welcome
+}
+
+func containsVersion(versions []int, version int) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// newEnvelope wraps the payload into an envelope of the given version
+func newEnvelope(version int, messageType string, id string, payload interface{}) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+	return Envelope{Version: version, Type: messageType, Id: id, Timestamp: time.Now().UTC(), Payload: data}, nil
+}
+
+// newEventEnvelope wraps the event into an envelope of the given version, along with its trace context
+func newEventEnvelope(version int, event SubscribeEventPayload) (Envelope, error) {
+	envelope, err := newEnvelope(version, messageTypeEvent, event.Id, event)
+	if err != nil {
+		return Envelope{}, err
+	}
+	envelope.TraceContext = event.TraceContext
+	return envelope, nil
+}
+
+// decodeEvent decodes the event of an event envelope, along with its trace context
+func decodeEvent(envelope Envelope) (SubscribeEventPayload, error) {
+	var event SubscribeEventPayload
+	if err := json.Unmarshal(envelope.Payload, &event); err != nil {
+		return event, err
+	}
+	event.TraceContext = envelope.TraceContext
+	return event, nil
+}
+
+// encodeEvent encodes the event for a receiver of the given protocol version.
+// Bare events of the legacy protocol don't carry the trace context.
+func encodeEvent(version int, event SubscribeEventPayload) ([]byte, error) {
+	if version == 0 {
+		return json.Marshal(event)
+	}
+	envelope, err := newEventEnvelope(version, event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// parseEnvelope decodes the message if it is an envelope
+func parseEnvelope(message []byte) (Envelope, bool) {
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil || envelope.Version == 0 || envelope.Type == "" {
+		return envelope, false
+	}
+	return envelope, true
+}
+
+// decodeMessage decodes a message sent by a server of any protocol version,
+// wrapping bare events of the legacy protocol into a version 0 envelope
+func decodeMessage(message []byte) (Envelope, error) {
+	if envelope, ok := parseEnvelope(message); ok {
+		return envelope, nil
+	}
+	var event SubscribeEventPayload
+	if err := json.Unmarshal(message, &event); err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Type: messageTypeEvent, Id: event.Id, Payload: message}, nil
+}
+
+// SubscriptionFilters describe events a client is interested in. Empty filters match all events.
+type SubscriptionFilters struct {
+	// URLPrefixes match image references without the oci:// scheme, e.g. "ghcr.io/codex-team/"
+	URLPrefixes []string `json:"urlPrefixes,omitempty" yaml:"urlPrefixes"`
+
+	// URLGlobs match image references without the oci:// scheme, e.g. "ghcr.io/codex-team/*"
+	URLGlobs []string `json:"urlGlobs,omitempty" yaml:"urlGlobs"`
+
+	// Tags are glob patterns for pushed tags, e.g. "v*"
+	Tags []string `json:"tags,omitempty" yaml:"tags"`
+}
+
+// Matches reports whether the event passes the filters. An event matches if its image matches
+// any prefix or glob (when any are set) and its tag matches any tag pattern (when any are set).
+func (f SubscriptionFilters) Matches(event SubscribeEventPayload) bool {
+	image := strings.TrimPrefix(event.OciUrl, "oci://")
+
+	if len(f.URLPrefixes) > 0 || len(f.URLGlobs) > 0 {
+		matched := matchAny(f.URLGlobs, image)
+		for _, prefix := range f.URLPrefixes {
+			if strings.HasPrefix(image, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return len(f.Tags) == 0 || matchAny(f.Tags, event.Tag)
+}
+
+// Validate checks that all glob patterns are well-formed
+func (f SubscriptionFilters) Validate() error {
+	for _, pattern := range append(append([]string{}, f.URLGlobs...), f.Tags...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns a compact representation of the filters for logs
+func (f SubscriptionFilters) String() string {
+	var parts []string
+	if len(f.URLPrefixes) > 0 {
+		parts = append(parts, "urlPrefixes="+strings.Join(f.URLPrefixes, ","))
+	}
+	if len(f.URLGlobs) > 0 {
+		parts = append(parts, "urlGlobs="+strings.Join(f.URLGlobs, ","))
+	}
+	if len(f.Tags) > 0 {
+		parts = append(parts, "tags="+strings.Join(f.Tags, ","))
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, ";")
+}
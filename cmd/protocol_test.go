@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hello    HelloMessage
+		features []string
+		want     WelcomeMessage
+	}{
+		{
+			name:     "legacy client",
+			hello:    HelloMessage{Features: []string{featureResults}},
+			features: []string{featureResults},
+			want:     WelcomeMessage{},
+		},
+		{
+			name:     "current version",
+			hello:    HelloMessage{Versions: []int{protocolVersion}},
+			features: []string{featureResults},
+			want:     WelcomeMessage{Version: protocolVersion},
+		},
+		{
+			name:     "newest common version",
+			hello:    HelloMessage{Versions: []int{protocolVersion + 1, protocolVersion}},
+			features: []string{featureResults},
+			want:     WelcomeMessage{Version: protocolVersion},
+		},
+		{
+			name:  "only newer versions",
+			hello: HelloMessage{Versions: []int{protocolVersion + 1}},
+			want:  WelcomeMessage{},
+		},
+		{
+			name:     "common features",
+			hello:    HelloMessage{Versions: []int{protocolVersion}, Features: []string{featureResults, "compression"}},
+			features: []string{featureResults},
+			want:     WelcomeMessage{Version: protocolVersion, Features: []string{featureResults}},
+		},
+		{
+			name:  "feature the transport doesn't support",
+			hello: HelloMessage{Versions: []int{protocolVersion}, Features: []string{featureResults}},
+			want:  WelcomeMessage{Version: protocolVersion},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := negotiate(test.hello, test.features); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("negotiated %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadyTrackingTimeout  = 5 * time.Minute
+	defaultReadyTrackingInterval = 2 * time.Second
+
+	// Objects waiting to be tracked, further objects are not tracked until the queue drains
+	readyTrackingQueueSize = 100
+)
+
+// readyRequest is an object annotated for reconciliation that is tracked until it becomes ready
+type readyRequest struct {
+	resource    schema.GroupVersionResource
+	kind        string
+	namespace   string
+	name        string
+	requestedAt string
+	event       SubscribeEventPayload
+}
+
+// ReadyTracker waits for reconciled objects to become ready and records the time from the push to readiness.
+// An object is ready once its controller handled the reconcile request and reports the Ready condition.
+type ReadyTracker struct {
+	client   dynamic.Interface
+	timeout  time.Duration
+	interval time.Duration
+	requests chan readyRequest
+	logger   *zap.Logger
+}
+
+func NewReadyTracker(client dynamic.Interface, config Config, logger *zap.Logger) *ReadyTracker {
+	return &ReadyTracker{
+		client:   client,
+		timeout:  config.ReadyTracking.Timeout,
+		interval: config.ReadyTracking.Interval,
+		requests: make(chan readyRequest, readyTrackingQueueSize),
+		logger:   logger,
+	}
+}
+
+// Track starts tracking the object annotated with the requestedAt reconcile request, it doesn't block.
+// Tracking is disabled when the tracker is nil.
+func (t *ReadyTracker) Track(resource schema.GroupVersionResource, kind string, namespace string, name string, requestedAt string, event SubscribeEventPayload) {
+	if t == nil {
+		return
+	}
+	request := readyRequest{resource: resource, kind: kind, namespace: namespace, name: name, requestedAt: requestedAt, event: event}
+	select {
+	case t.requests <- request:
+	default:
+		t.logger.Warn("Too many objects tracked, not waiting for readiness", zap.String("kind", kind), zap.String("namespace", namespace), zap.String("name", name))
+	}
+}
+
+// Run tracks objects until the context is done, objects still tracked then are not counted as timed out
+func (t *ReadyTracker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-t.requests:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.await(ctx, request)
+			}()
+		}
+	}
+}
+
+// await polls the object until it is ready or the timeout expires
+func (t *ReadyTracker) await(ctx context.Context, request readyRequest) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	logger := t.logger.With(zap.String("kind", request.kind), zap.String("namespace", request.namespace), zap.String("name", request.name))
+	labels := prometheus.Labels{"kind": request.kind, "namespace": request.namespace}
+	for {
+		object, err := t.client.Resource(request.resource).Namespace(request.namespace).Get(ctx, request.name, metav1.GetOptions{})
+		if err != nil && ctx.Err() == nil {
+			logger.Debug("Failed to get object to check readiness", zap.Error(err))
+		}
+		if err == nil && isReady(object, request.requestedAt) {
+			revision, _, _ := unstructured.NestedString(object.Object, "status", "artifact", "revision")
+			if latency, ok := request.event.sinceReceived(); ok {
+				readyLatency.With(labels).Observe(latency.Seconds())
+				logger.Info("Object is ready", zap.String("revision", revision), zap.Duration("sincePush", latency))
+			} else {
+				logger.Info("Object is ready", zap.String("revision", revision))
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				logger.Warn("Object didn't become ready in time", zap.Duration("timeout", t.timeout))
+				readyTimeouts.With(labels).Inc()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isReady reports whether the controller handled the reconcile request and the object's Ready condition
+// is true for its current generation
+func isReady(object *unstructured.Unstructured, requestedAt string) bool {
+	handledAt, _, _ := unstructured.NestedString(object.Object, "status", "lastHandledReconcileAt")
+	if handledAt != requestedAt {
+		return false
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(object.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != "Ready" {
+			continue
+		}
+		if observed, ok, _ := unstructured.NestedInt64(condition, "observedGeneration"); ok && observed < object.GetGeneration() {
+			return false
+		}
+		return condition["status"] == string(metav1.ConditionTrue)
+	}
+	return false
+}
@@ -6,44 +6,188 @@ import (
 	fluxMeta "github.com/fluxcd/pkg/apis/meta"
 	sourceController "github.com/fluxcd/source-controller/api/v1beta2"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 )
 
+var ociRepositoriesResource = schema.GroupVersionResource{
+	Group:    "source.toolkit.fluxcd.io",
+	Version:  "v1beta2",
+	Resource: "ocirepositories",
+}
+
 type Reconciler struct {
-	restClient *rest.RESTClient
-	logger     *zap.Logger
+	config        Config
+	restClient    *rest.RESTClient
+	dynamicClient dynamic.Interface
+	policies      *PolicyStore
+	// ready is nil without ready tracking
+	ready *ReadyTracker
+	// leader is nil without leader election
+	leader *LeaderElector
+	logger *zap.Logger
 }
 
-func NewReconciler(client *rest.RESTClient, logger *zap.Logger) *Reconciler {
+func NewReconciler(config Config, client *rest.RESTClient, dynamicClient dynamic.Interface, policies *PolicyStore, ready *ReadyTracker, leader *LeaderElector, logger *zap.Logger) *Reconciler {
 	return &Reconciler{
-		restClient: client,
-		logger:     logger,
+		config:        config,
+		restClient:    client,
+		dynamicClient: dynamicClient,
+		policies:      policies,
+		ready:         ready,
+		leader:        leader,
+		logger:        logger,
+	}
+}
+
+// ReconcileResult is the outcome of requesting reconciliation of a single object
+type ReconcileResult struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newReconcileResult(kind string, namespace string, name string, err error) ReconcileResult {
+	result := ReconcileResult{Kind: kind, Namespace: namespace, Name: name}
+	if err != nil {
+		result.Error = err.Error()
 	}
+	return result
 }
 
-func (r *Reconciler) ReconcileSources(ociUrl string, tag string) {
+// ReconcileSources requests reconciliation of sources of the pushed image and returns the outcome for every matching object
+// Followers of the leader election skip reconciliation, the leader reconciles for them.
+func (r *Reconciler) ReconcileSources(event SubscribeEventPayload) []ReconcileResult {
+	if !r.leader.IsLeader() {
+		r.logger.Debug("Not the leader, skipping reconciliation", zap.String("ociUrl", event.OciUrl), zap.String("tag", event.Tag))
+		return nil
+	}
+
+	ctx, span := tracer.Start(event.traceContext(), "Reconciler.ReconcileSources", eventAttributes(event))
+	defer span.End()
+
+	var results []ReconcileResult
 	var res sourceController.OCIRepositoryList
-	err := r.restClient.Get().Resource("ocirepositories").Namespace("").Do(context.Background()).Into(&res)
+	err := r.restClient.Get().Resource("ocirepositories").Namespace("").Do(ctx).Into(&res)
 	if err != nil {
 		r.logger.Error("Failed to get OCIRepositories", zap.Error(err))
 	}
 	for _, ociRepository := range res.Items {
-		if ociRepository.Spec.URL == ociUrl && ociRepository.Spec.Reference.Tag == tag {
+		if ociRepository.Spec.URL == event.OciUrl && ociRepository.Spec.Reference.Tag == event.Tag {
+			allowed, policies := r.permits(kindOCIRepository, ociRepository.Namespace, ociRepository.Labels, event, true)
+			if !allowed {
+				r.logger.Info("OCIRepository is not allowed for the event", zap.String("name", ociRepository.Name), zap.String("namespace", ociRepository.Namespace))
+				continue
+			}
+
 			r.logger.Info("Reconciling OCIRepository", zap.String("name", ociRepository.Name), zap.String("namespace", ociRepository.Namespace))
-			err := r.annotateRepository(ociRepository)
+			requestedAt := reconcileRequestedAt()
+			err := r.annotateRepository(ctx, ociRepository, requestedAt)
+			results = append(results, newReconcileResult(kindOCIRepository, ociRepository.Namespace, ociRepository.Name, err))
+			recordReconciliation(kindOCIRepository, ociRepository.Namespace, ociRepository.Name, event, err)
 			if err != nil {
 				r.logger.Error("Failed to annotate OCIRepository", zap.Error(err))
-				reconciledCount.With(prometheus.Labels{"name": ociRepository.Name, "status": "fail", "namespace": ociRepository.Namespace}).Inc()
+				continue
 			}
-			reconciledCount.With(prometheus.Labels{"name": ociRepository.Name, "status": "success", "namespace": ociRepository.Namespace}).Inc()
+			r.ready.Track(ociRepositoriesResource, kindOCIRepository, ociRepository.Namespace, ociRepository.Name, requestedAt, event)
+			r.markTriggered(policies)
 		}
 	}
+
+	if r.config.ImageAutomation.Enabled || (r.policies != nil && r.policies.CascadesImages()) {
+		results = append(results, r.ReconcileImageRepositories(event)...)
+	}
+	return results
 }
 
-func (r *Reconciler) annotateRepository(repository sourceController.OCIRepository) error {
+// recordReconciliation records metrics of a reconciliation request, the latency is measured from the webhook to successful requests
+func recordReconciliation(kind string, namespace string, name string, event SubscribeEventPayload, err error) {
+	if err != nil {
+		reconciledCount.With(prometheus.Labels{"name": name, "status": "fail", "namespace": namespace, "kind": kind}).Inc()
+		return
+	}
+	reconciledCount.With(prometheus.Labels{"name": name, "status": "success", "namespace": namespace, "kind": kind}).Inc()
+	if latency, ok := event.sinceReceived(); ok {
+		reconcileLatency.With(prometheus.Labels{"kind": kind, "provider": event.provider()}).Observe(latency.Seconds())
+	}
+}
+
+// reconcilesLocally reports whether this replica reconciles events it receives itself, followers of the leader election don't
+func (r *Reconciler) reconcilesLocally() bool {
+	return r.leader.IsLeader()
+}
+
+// reconcilesForReplicas reports whether this replica is the leader of the leader election,
+// which reconciles events other replicas received
+func (r *Reconciler) reconcilesForReplicas() bool {
+	return r.leader != nil && r.leader.IsLeader()
+}
+
+// permits reports whether an object may be reconciled for the event and returns the policies that allowed it.
+// Objects in namespaces without policies fall back to the given default from the global config.
+// Objects outside the namespaces the event is restricted to are never permitted, and no object is
+// permitted before the policies are known.
+func (r *Reconciler) permits(kind string, namespace string, objectLabels map[string]string, event SubscribeEventPayload, fallback bool) (bool, []AutoReconcilePolicy) {
+	if len(event.Namespaces) > 0 && !contains(event.Namespaces, namespace) {
+		return false, nil
+	}
+
+	if r.policies == nil {
+		return fallback, nil
+	}
+
+	governed, policies, err := r.policies.Match(kind, namespace, objectLabels, event)
+	if err != nil {
+		r.logger.Warn("Denying reconciliation until policies are known", zap.Error(err), zap.String("kind", kind), zap.String("namespace", namespace))
+		return false, nil
+	}
+	if !governed {
+		return fallback, nil
+	}
+	return len(policies) > 0, policies
+}
+
+func (r *Reconciler) markTriggered(policies []AutoReconcilePolicy) {
+	if r.policies != nil && len(policies) > 0 {
+		r.policies.MarkTriggered(policies)
+	}
+}
+
+func (r *Reconciler) annotateRepository(ctx context.Context, repository sourceController.OCIRepository, requestedAt string) error {
+	ctx, span := tracer.Start(ctx, "Reconciler.annotateRepository", trace.WithAttributes(
+		attribute.String("k8s.namespace.name", repository.Namespace),
+		attribute.String("flux.ocirepository.name", repository.Name),
+	))
+
+	var res sourceController.OCIRepository
+	err := r.restClient.
+		Patch(types.MergePatchType).
+		Resource("ocirepositories").
+		Namespace(repository.Namespace).
+		Name(repository.Name).
+		Body(reconcileRequestPatch(requestedAt)).
+		Do(ctx).
+		Into(&res)
+	endSpan(span, err)
+	return err
+}
+
+// reconcileRequestedAt returns a new value of the reconcile request annotation, controllers
+// report the value of the last request they handled in status.lastHandledReconcileAt
+func reconcileRequestedAt() string {
+	return metav1.Now().String()
+}
+
+// reconcileRequestPatch builds a merge patch that sets the Flux reconcile request annotation,
+// which makes the owning controller reconcile the object as soon as possible.
+func reconcileRequestPatch(requestedAt string) []byte {
 	patch := struct {
 		Metadata struct {
 			Annotations map[string]string `json:"annotations"`
@@ -52,17 +196,9 @@ func (r *Reconciler) annotateRepository(repository sourceController.OCIRepositor
 
 	patch.Metadata.Annotations = make(map[string]string)
 
-	patch.Metadata.Annotations[fluxMeta.ReconcileRequestAnnotation] = metav1.Now().String()
+	patch.Metadata.Annotations[fluxMeta.ReconcileRequestAnnotation] = requestedAt
 
 	patchJson, _ := json.Marshal(patch)
 
-	var res sourceController.OCIRepository
-	return r.restClient.
-		Patch(types.MergePatchType).
-		Resource("ocirepositories").
-		Namespace(repository.Namespace).
-		Name(repository.Name).
-		Body(patchJson).
-		Do(context.Background()).
-		Into(&res)
+	return patchJson
 }
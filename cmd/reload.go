@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// How often the config file and files it references are checked for changes when the config doesn't specify it
+const defaultConfigReloadInterval = 10 * time.Second
+
+// referencedFiles returns files the config refers to and files secrets were read from,
+// a change of their contents reloads the config
+func (c Config) referencedFiles() []string {
+	files := append([]string{}, c.secretFiles...)
+	for _, file := range []string{c.JWT.JWKSFile, c.SubscribeTokenFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// withReloadable returns the config with settings applied on reload taken from the loaded config,
+// other settings need a restart to take effect
+func (c Config) withReloadable(loaded Config) Config {
+	c.GithubSecret = loaded.GithubSecret
+	c.GithubSecrets = loaded.GithubSecrets
+	c.SubscribeSecret = loaded.SubscribeSecret
+	c.SubscribeTokens = loaded.SubscribeTokens
+	c.SubscribeTokenFile = loaded.SubscribeTokenFile
+	c.JWT = loaded.JWT
+	c.GRPC.AdminToken = loaded.GRPC.AdminToken
+	c.Relay.UpstreamSecret = loaded.Relay.UpstreamSecret
+	c.Cluster = loaded.Cluster
+	c.Subscription = loaded.Subscription
+	c.Notifications = loaded.Notifications
+	c.GithubStatus = loaded.GithubStatus
+	c.LogLevel = loaded.LogLevel
+	return c
+}
+
+// configHash hashes the config file, if any, and the files it references
+func configHash(path string, files []string) (string, error) {
+	if path != "" {
+		files = append([]string{path}, files...)
+	}
+	h := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", file, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// applyLogLevel sets the log level from the config, the level is validated when the config is loaded
+func applyLogLevel(level zap.AtomicLevel, config Config) {
+	if parsed, err := zapcore.ParseLevel(config.LogLevel); err == nil {
+		level.SetLevel(parsed)
+	}
+}
+
+// ConfigWatcher polls the config file and files it references, loading the config when their contents change.
+// Environment variables and flags are applied to every loaded config.
+// A valid config is applied to all components at once, an invalid one is rejected and the active config is kept.
+// Polling works with ConfigMaps and Secrets mounted by Kubernetes, which replace files through symlinks.
+type ConfigWatcher struct {
+	path     string
+	flags    ConfigFlags
+	interval time.Duration
+	level    zap.AtomicLevel
+	logger   *zap.Logger
+
+	m         sync.Mutex
+	reloaders []func(config Config)
+	active    Config
+	// hash of the files when they were last loaded, a rejected config isn't loaded again until the files change
+	hash string
+}
+
+// NewConfigWatcher reports the hash of the loaded config, which is loaded again with the same flags on changes
+func NewConfigWatcher(path string, flags ConfigFlags, config Config, level zap.AtomicLevel, logger *zap.Logger) *ConfigWatcher {
+	hash, err := configHash(path, config.referencedFiles())
+	if err != nil {
+		logger.Warn("Failed to hash config", zap.Error(err))
+	}
+	configInfo.With(prometheus.Labels{"hash": hash}).Set(1)
+
+	return &ConfigWatcher{
+		path:     path,
+		flags:    flags,
+		interval: config.Reload.Interval,
+		level:    level,
+		logger:   logger,
+		active:   config,
+		hash:     hash,
+	}
+}
+
+// OnReload registers a function applying reloaded configs. A nil watcher doesn't reload anything.
+func (w *ConfigWatcher) OnReload(reload func(config Config)) {
+	if w == nil {
+		return
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.reloaders = append(w.reloaders, reload)
+}
+
+// Run checks for changes until the context is done
+func (w *ConfigWatcher) Run(ctx context.Context) {
+	w.logger.Info("Watching config for changes", zap.String("path", w.path), zap.Duration("interval", w.interval))
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+func (w *ConfigWatcher) check() {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	hash, err := configHash(w.path, w.active.referencedFiles())
+	if err == nil && hash == w.hash {
+		return
+	}
+
+	// a file the active config references may be gone because the new config doesn't reference it anymore
+	loaded, err := LoadConfig(w.path, w.flags)
+	if err == nil {
+		// the config may reference other files now, they are hashed to detect their changes from now on
+		hash, err = configHash(w.path, loaded.referencedFiles())
+	}
+	if err != nil {
+		// files being replaced may be unreadable for a moment, failures are reported once until the files change
+		if hash != w.hash {
+			w.reject(err)
+		}
+		w.hash = hash
+		return
+	}
+	w.hash = hash
+
+	static := loaded.withReloadable(w.active)
+	// generated when not configured
+	static.InstanceId = w.active.InstanceId
+	if !reflect.DeepEqual(static, w.active) {
+		w.logger.Warn("Config changes other than secrets, subscription filters, notifications and the log level require a restart")
+	}
+
+	w.active = w.active.withReloadable(loaded)
+	applyLogLevel(w.level, w.active)
+	for _, reload := range w.reloaders {
+		reload(w.active)
+	}
+
+	configReloads.With(prometheus.Labels{"status": "success"}).Inc()
+	configInfo.Reset()
+	configInfo.With(prometheus.Labels{"hash": hash}).Set(1)
+	w.logger.Info("Reloaded config", zap.String("hash", hash))
+}
+
+func (w *ConfigWatcher) reject(err error) {
+	configReloads.With(prometheus.Labels{"status": "fail"}).Inc()
+	w.logger.Error("Failed to reload config, keeping the active config", zap.Error(err), zap.String("path", w.path))
+}
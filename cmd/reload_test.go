@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigWatcherCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// wantSecret is the subscribe secret of the active config after the check, empty if the config is rejected
+		wantSecret string
+	}{
+		{name: "valid config", config: "mode: server\nsubscribeSecret: new\n", wantSecret: "new"},
+		{name: "invalid YAML", config: "mode: server\nsubscribeSecret: [new\n"},
+		{name: "failed validation", config: "mode: bogus\nsubscribeSecret: new\n"},
+		{name: "invalid value", config: "mode: server\nsubscribeSecret: new\nshutdownTimeout: soon\n"},
+		{name: "missing referenced file", config: "mode: server\nsubscribeSecret: new\nsubscribeTokenFile: /nonexistent/token\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte("mode: server\nsubscribeSecret: old\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			watcher := NewConfigWatcher(path, nil, config, zap.NewAtomicLevel(), zap.NewNop())
+			var reloaded []Config
+			watcher.OnReload(func(config Config) {
+				reloaded = append(reloaded, config)
+			})
+
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			failures := testutil.ToFloat64(configReloads.With(prometheus.Labels{"status": "fail"}))
+			watcher.check()
+
+			failed := testutil.ToFloat64(configReloads.With(prometheus.Labels{"status": "fail"})) - failures
+			if test.wantSecret == "" {
+				if len(reloaded) > 0 || failed != 1 || watcher.active.SubscribeSecret != "old" {
+					t.Errorf("reloaded %d times with %v failures and subscribe secret %q, want the config rejected",
+						len(reloaded), failed, watcher.active.SubscribeSecret)
+				}
+				return
+			}
+			if len(reloaded) != 1 || reloaded[0].SubscribeSecret != test.wantSecret || failed != 0 {
+				t.Errorf("reloaded %d times with %v failures, want a reload with subscribe secret %q", len(reloaded), failed, test.wantSecret)
+			}
+
+			// unchanged files aren't loaded again
+			watcher.check()
+			if len(reloaded) != 1 {
+				t.Errorf("reloaded %d times without changes, want 1", len(reloaded))
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"time"
+)
+
+const (
+	// Annotation on tenant Secrets that listed additional namespaces, it's ignored since the namespaces
+	// are configured on the endpoint, which tenants can't change
+	allowedNamespacesAnnotation = "autoreconcile.codex.so/allowed-namespaces"
+
+	// Key of the Secret data used when the endpoint doesn't specify one.
+	defaultTenantSecretKey = "secret"
+
+	// How often the Secret informers resync their caches.
+	tenantSecretResyncPeriod = 10 * time.Minute
+)
+
+// tenantEndpoint is a webhook endpoint whose secret is read from a watched Kubernetes Secret
+type tenantEndpoint struct {
+	config   WebhookEndpoint
+	informer cache.SharedIndexInformer
+	lister   listers.SecretNamespaceLister
+}
+
+// TenantWebhooks keeps secrets of per-tenant webhook endpoints in sync with Kubernetes Secrets
+type TenantWebhooks struct {
+	endpoints map[string]*tenantEndpoint
+	logger    *zap.Logger
+}
+
+func NewTenantWebhooks(client kubernetes.Interface, endpoints []WebhookEndpoint, logger *zap.Logger) *TenantWebhooks {
+	tenants := &TenantWebhooks{
+		endpoints: make(map[string]*tenantEndpoint),
+		logger:    logger,
+	}
+
+	for _, endpoint := range endpoints {
+		name := endpoint.SecretRef.Name
+		factory := informers.NewSharedInformerFactoryWithOptions(
+			client,
+			tenantSecretResyncPeriod,
+			informers.WithNamespace(endpoint.SecretRef.Namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			}),
+		)
+		secrets := factory.Core().V1().Secrets()
+		tenants.endpoints[endpoint.Path] = &tenantEndpoint{
+			config:   endpoint,
+			informer: secrets.Informer(),
+			lister:   secrets.Lister().Secrets(endpoint.SecretRef.Namespace),
+		}
+	}
+
+	return tenants
+}
+
+// Run starts watching tenant Secrets until the context is done
+func (t *TenantWebhooks) Run(ctx context.Context) {
+	for _, endpoint := range t.endpoints {
+		go endpoint.informer.Run(ctx.Done())
+	}
+
+	for path, endpoint := range t.endpoints {
+		if !cache.WaitForCacheSync(ctx.Done(), endpoint.informer.HasSynced) {
+			return
+		}
+		t.logger.Info("Watching webhook secret", zap.String("path", path), zap.String("namespace", endpoint.config.SecretRef.Namespace), zap.String("name", endpoint.config.SecretRef.Name))
+	}
+}
+
+// Paths returns the paths of all tenant endpoints
+func (t *TenantWebhooks) Paths() []string {
+	paths := make([]string, 0, len(t.endpoints))
+	for path := range t.endpoints {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Secret returns the current secret of the endpoint and the namespaces whose sources its events may reconcile.
+// Events are restricted to the namespace owning the Secret plus the namespaces configured for the endpoint,
+// the Secret only provides the key.
+func (t *TenantWebhooks) Secret(path string) ([]byte, []string, error) {
+	endpoint, ok := t.endpoints[path]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown webhook endpoint %s", path)
+	}
+
+	secret, err := endpoint.lister.Get(endpoint.config.SecretRef.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := endpoint.config.SecretRef.Key
+	if key == "" {
+		key = defaultTenantSecretKey
+	}
+
+	value, ok := secret.Data[key]
+	if !ok || len(value) == 0 {
+		return nil, nil, fmt.Errorf("secret %s/%s has no key %s", secret.Namespace, secret.Name, key)
+	}
+
+	if _, ok := secret.Annotations[allowedNamespacesAnnotation]; ok {
+		t.logger.Warn("Ignoring allowed namespaces annotation of webhook secret, configure namespaces of the endpoint instead",
+			zap.String("namespace", secret.Namespace), zap.String("name", secret.Name))
+	}
+
+	namespaces := []string{secret.Namespace}
+	for _, namespace := range endpoint.config.Namespaces {
+		if !contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	return value, namespaces, nil
+}
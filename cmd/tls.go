@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate from files, reloading it when the files change,
+// so rotated certificates are picked up without restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+
+	m        sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, logger *zap.Logger) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if _, err := reloader.certificate(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// certificate returns the current certificate, reloading it if the files were modified.
+// If reloading fails, the previous certificate is kept.
+func (c *certReloader) certificate() (*tls.Certificate, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	certInfo, certErr := os.Stat(c.certFile)
+	keyInfo, keyErr := os.Stat(c.keyFile)
+	if certErr == nil && keyErr == nil && c.cert != nil && certInfo.ModTime().Equal(c.certTime) && keyInfo.ModTime().Equal(c.keyTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			c.logger.Error("Failed to reload certificate, using the previous one", zap.Error(err))
+			return c.cert, nil
+		}
+		return nil, err
+	}
+
+	if c.cert != nil {
+		c.logger.Info("Reloaded certificate", zap.String("certFile", c.certFile))
+	}
+	c.cert = &cert
+	if certErr == nil && keyErr == nil {
+		c.certTime = certInfo.ModTime()
+		c.keyTime = keyInfo.ModTime()
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate()
+}
+
+func (c *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.certificate()
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig builds the TLS config of the server, or returns nil if TLS is not configured
+func serverTLSConfig(config Config, logger *zap.Logger) (*tls.Config, error) {
+	if config.TLS.CertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(config.TLS.CertFile, config.TLS.KeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.TLS.ClientCAFile != "" {
+		pool, err := loadCertPool(config.TLS.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.TLS.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// clientTLSConfig builds the TLS config used to dial the server, pinning the CA and presenting a client certificate if configured
+func clientTLSConfig(config Config, logger *zap.Logger) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.TLS.CAFile != "" {
+		pool, err := loadCertPool(config.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLS.CertFile != "" {
+		reloader, err := newCertReloader(config.TLS.CertFile, config.TLS.KeyFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	// Service name reported in traces when the config doesn't specify one
+	defaultTracingServiceName = "flux-webhook-autoreconciler"
+
+	// Time allowed for exporting remaining spans on shutdown
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// tracer creates spans with the globally configured provider, which doesn't record anything unless tracing is enabled
+var tracer = otel.Tracer("flux-webhook-autoreconciler")
+
+// setupTracing configures export of spans over OTLP if tracing is enabled and returns a function flushing remaining spans
+func setupTracing(ctx context.Context, config Config, logger *zap.Logger) func(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !config.Tracing.Enabled {
+		return func(context.Context) error { return nil }
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Tracing.Endpoint)}
+	if config.Tracing.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		logger.Fatal("Failed to create trace exporter", zap.Error(err))
+	}
+
+	serviceName := config.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceInstanceID(config.InstanceId),
+		attribute.String("autoreconciler.mode", config.Mode),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*config.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("Exporting traces", zap.String("endpoint", config.Tracing.Endpoint), zap.Float64("sampleRatio", *config.Tracing.SampleRatio))
+
+	return provider.Shutdown
+}
+
+// traceContext returns a context carrying the trace the event belongs to
+func (e SubscribeEventPayload) traceContext() context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(e.TraceContext))
+}
+
+// withTraceContext returns the event with the trace context of ctx, so spans of its receivers join the trace
+func (e SubscribeEventPayload) withTraceContext(ctx context.Context) SubscribeEventPayload {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	e.TraceContext = carrier
+	return e
+}
+
+// eventAttributes describe the event on spans
+func eventAttributes(event SubscribeEventPayload) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("event.id", event.Id),
+		attribute.String("event.oci_url", event.OciUrl),
+		attribute.String("event.tag", event.Tag),
+	)
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
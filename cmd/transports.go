@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	transportWebsocket = "websocket"
+	transportSSE       = "sse"
+	transportPoll      = "poll"
+	transportGRPC      = "grpc"
+)
+
+// Protocol features supported on each transport. SSE and long-poll clients can't send messages after connecting.
+var transportFeatures = map[string][]string{
+	transportWebsocket: {featureResults},
+}
+
+const (
+	// How long a poll request waits for events before responding with an empty list.
+	pollTimeout = 25 * time.Second
+
+	// Poll sessions not polled for this long are dropped.
+	pollSessionTTL = 2 * pollTimeout
+
+	// Send SSE keep-alive comments with this period, so proxies don't close idle streams.
+	sseKeepAlivePeriod = 15 * time.Second
+
+	// Type of the SSE event ending the stream when the server shuts down, its data is goingAwayReason
+	sseEventGoingAway = "goaway"
+)
+
+// PollResponse is returned by the long-poll endpoint
+type PollResponse struct {
+	Session string                  `json:"session"`
+	Events  []SubscribeEventPayload `json:"events"`
+
+	// Messages replace events for clients that negotiated protocol version 1 or newer
+	Messages []Envelope `json:"messages,omitempty"`
+}
+
+// pollSession is identified by a random secret known only to the client that created it, which is separate
+// from the client ID listed by the admin endpoint. Polls must authenticate with the identity that created it.
+type pollSession struct {
+	subscriber *Subscriber
+	lastPoll   time.Time
+}
+
+// newPollSessionId returns a random session secret
+func newPollSessionId() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// helloFromQuery reads the optional hello message sent in the "hello" query parameter by SSE and poll clients
+func helloFromQuery(r *http.Request) (HelloMessage, bool, error) {
+	raw := r.URL.Query().Get("hello")
+	if raw == "" {
+		return HelloMessage{}, false, nil
+	}
+	var hello HelloMessage
+	if err := json.Unmarshal([]byte(raw), &hello); err != nil {
+		return hello, false, err
+	}
+	if err := hello.Filters.Validate(); err != nil {
+		return hello, false, err
+	}
+	return hello, true, nil
+}
+
+// SubscribeSSE streams events to the subscriber as Server-Sent Events
+func (s *Handlers) SubscribeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	hello, hasHello, err := helloFromQuery(r)
+	if err != nil {
+		http.Error(w, "Invalid hello message", http.StatusBadRequest)
+		return
+	}
+
+	subscr, ok := s.authenticate(w, r, transportSSE)
+	if !ok {
+		return
+	}
+	if !s.connect() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.active.Done()
+
+	welcome := WelcomeMessage{}
+	if hasHello {
+		subscr.announce(hello)
+		welcome = subscr.negotiate(hello)
+	}
+
+	s.RegisterClient(subscr)
+	defer func() {
+		s.UnregisterClient(subscr)
+		s.logger.Info("Unregistered subscr", zap.String("clientId", subscr.id))
+	}()
+	s.logger.Info("Registered subscr", zap.String("clientId", subscr.id))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disable response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if welcome.Version > 0 {
+		if err := writeSSEWelcome(w, welcome); err != nil {
+			s.logger.Error("Error writing message", zap.Error(err), zap.String("clientId", subscr.id))
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.shutdown:
+			// clients reconnect to another replica right away on going away
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", sseEventGoingAway, goingAwayReason); err != nil {
+				s.logger.Error("Error writing going away event", zap.Error(err), zap.String("clientId", subscr.id))
+				return
+			}
+			flusher.Flush()
+			return
+		case <-subscr.revoked:
+			return
+		case message := <-subscr.send:
+			buff, err := subscr.encode(message)
+			if err != nil {
+				s.logger.Error("Error marshalling message", zap.Error(err), zap.String("clientId", subscr.id))
+				break
+			}
+			if _, err := fmt.Fprintf(w, "event: event\ndata: %s\n\n", buff); err != nil {
+				s.logger.Error("Error writing message", zap.Error(err), zap.String("clientId", subscr.id))
+				return
+			}
+			flusher.Flush()
+			subscr.sent(message)
+			s.logger.Info("Sent message", zap.String("clientId", subscr.id))
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				s.logger.Error("Error writing keep-alive", zap.Error(err), zap.String("clientId", subscr.id))
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSEWelcome writes the welcome message as a Server-Sent Event
+func writeSSEWelcome(w io.Writer, welcome WelcomeMessage) error {
+	envelope, err := welcomeEnvelope(welcome)
+	if err != nil {
+		return err
+	}
+	buff, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", messageTypeWelcome, buff)
+	return err
+}
+
+// SubscribePoll serves long-poll subscribers. A request without a session creates one and responds immediately,
+// requests with a session wait up to pollTimeout for events queued since the previous poll.
+func (s *Handlers) SubscribePoll(w http.ResponseWriter, r *http.Request) {
+	s.expirePollSessions()
+
+	sessionId := r.URL.Query().Get("session")
+	if sessionId == "" {
+		s.createPollSession(w, r)
+		return
+	}
+
+	// every poll is authenticated, so revoked credentials take effect on the next request
+	token, _ := subscriberCredentials(r)
+	config := s.config()
+	identity, err := authenticateSubscriber(config.Config, config.jwtVerifier, token)
+	if err != nil {
+		http.Error(w, "Invalid auth secret", http.StatusUnauthorized)
+		return
+	}
+
+	s.m.Lock()
+	session, ok := s.pollSessions[sessionId]
+	if ok && session.subscriber.identity == identity.Name {
+		session.lastPoll = time.Now()
+	}
+	s.m.Unlock()
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	clientId := session.subscriber.id
+	if session.subscriber.identity != identity.Name {
+		s.logger.Warn("Poll of a session created by another subscriber", zap.String("clientId", clientId), zap.String("clientName", identity.Name))
+		http.Error(w, "Invalid auth secret", http.StatusForbidden)
+		return
+	}
+
+	response := PollResponse{Session: sessionId, Events: []SubscribeEventPayload{}}
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+
+	var events []SubscribeEventPayload
+	select {
+	case message := <-session.subscriber.send:
+		events = append(events, message)
+		// drain events queued together with the first one
+		for drained := false; !drained; {
+			select {
+			case message := <-session.subscriber.send:
+				events = append(events, message)
+			default:
+				drained = true
+			}
+		}
+	case <-timer.C:
+	case <-s.shutdown:
+	case <-r.Context().Done():
+		return
+	}
+
+	version := session.subscriber.negotiatedVersion()
+	for _, event := range events {
+		session.subscriber.sent(event)
+		if version == 0 {
+			response.Events = append(response.Events, event)
+			continue
+		}
+		envelope, err := newEventEnvelope(version, event)
+		if err != nil {
+			s.logger.Error("Error marshalling message", zap.Error(err), zap.String("clientId", clientId))
+			continue
+		}
+		response.Messages = append(response.Messages, envelope)
+	}
+
+	s.m.Lock()
+	session.lastPoll = time.Now()
+	s.m.Unlock()
+
+	s.writePollResponse(w, response)
+}
+
+func (s *Handlers) createPollSession(w http.ResponseWriter, r *http.Request) {
+	hello, hasHello, err := helloFromQuery(r)
+	if err != nil {
+		http.Error(w, "Invalid hello message", http.StatusBadRequest)
+		return
+	}
+
+	subscr, ok := s.authenticate(w, r, transportPoll)
+	if !ok {
+		return
+	}
+	sessionId, err := newPollSessionId()
+	if err != nil {
+		s.logger.Error("Failed to create poll session", zap.Error(err), zap.String("clientId", subscr.id))
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	response := PollResponse{Session: sessionId, Events: []SubscribeEventPayload{}}
+	if hasHello {
+		subscr.announce(hello)
+		if welcome := subscr.negotiate(hello); welcome.Version > 0 {
+			envelope, err := welcomeEnvelope(welcome)
+			if err != nil {
+				http.Error(w, "Error marshalling message", http.StatusInternalServerError)
+				return
+			}
+			response.Messages = append(response.Messages, envelope)
+		}
+	}
+
+	s.RegisterClient(subscr)
+	s.m.Lock()
+	s.pollSessions[sessionId] = &pollSession{subscriber: subscr, lastPoll: time.Now()}
+	s.m.Unlock()
+	s.logger.Info("Registered subscr", zap.String("clientId", subscr.id))
+
+	s.writePollResponse(w, response)
+}
+
+func (s *Handlers) writePollResponse(w http.ResponseWriter, response PollResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Error("Error writing poll response", zap.Error(err))
+	}
+}
+
+// expirePollSessions unregisters poll sessions whose clients stopped polling or whose credentials were revoked
+func (s *Handlers) expirePollSessions() {
+	var expired []*Subscriber
+
+	s.m.Lock()
+	for id, session := range s.pollSessions {
+		if time.Since(session.lastPoll) > pollSessionTTL || session.subscriber.isRevoked() {
+			expired = append(expired, session.subscriber)
+			delete(s.pollSessions, id)
+		}
+	}
+	s.m.Unlock()
+
+	for _, subscr := range expired {
+		s.UnregisterClient(subscr)
+		s.logger.Info("Unregistered expired poll subscr", zap.String("clientId", subscr.id))
+	}
+}